@@ -0,0 +1,69 @@
+package exporter
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// errCircuitOpen is the scrape error of a target that is being backed off.
+var errCircuitOpen = errors.New("endpoint is backed off after repeated failures")
+
+// SetFailureThreshold creates a function that will stop scraping an endpoint
+// after threshold consecutive failed scrapes, exporting phpfpm_up 0 without
+// contacting php-fpm, and only try again every backoff until a scrape
+// succeeds. A zero threshold disables it.
+// Generally only used when create a new Exporter.
+func SetFailureThreshold(threshold int, backoff time.Duration) func(*Exporter) error {
+	return func(e *Exporter) error {
+		if threshold < 0 {
+			return errors.New("failure threshold must not be negative")
+		}
+		if threshold > 0 && backoff <= 0 {
+			return errors.New("failure backoff must be positive")
+		}
+		e.failureThreshold = threshold
+		e.failureBackoff = backoff
+		return nil
+	}
+}
+
+// breaker tracks the consecutive failed scrapes of a target.
+type breaker struct {
+	failures int
+	// openUntil is the time of the next scrape while the target is backed
+	// off, and reason and category describe the failure that caused it.
+	openUntil time.Time
+	reason    string
+	category  string
+}
+
+// open reports whether the target is backed off at now.
+func (b *breaker) open(now time.Time) bool {
+	return now.Before(b.openUntil)
+}
+
+// failed records a failed scrape of t, backing off once the threshold of
+// consecutive failures is reached.
+func (c *collector) failed(t *target, reason, category string, now time.Time) {
+	threshold := c.exporter.failureThreshold
+	t.breaker.failures++
+	if threshold == 0 || t.breaker.failures < threshold {
+		return
+	}
+	if t.breaker.failures == threshold {
+		c.exporter.logger.Warn("php-fpm failed repeatedly, backing off", zap.String("target", t.url.String()), zap.Int("failures", t.breaker.failures), zap.Duration("backoff", c.exporter.failureBackoff))
+	}
+	t.breaker.openUntil = now.Add(c.exporter.failureBackoff)
+	t.breaker.reason = reason
+	t.breaker.category = category
+}
+
+// succeeded records a successful scrape of t, ending a backoff.
+func (c *collector) succeeded(t *target) {
+	if threshold := c.exporter.failureThreshold; threshold > 0 && t.breaker.failures >= threshold {
+		c.exporter.logger.Info("php-fpm is back, resuming scrapes", zap.String("target", t.url.String()))
+	}
+	t.breaker = breaker{}
+}
@@ -0,0 +1,85 @@
+package exporter
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SetTLSClientFiles creates a function that will present the client
+// certificate in certFile and keyFile on HTTPS scrapes and verify endpoints
+// against the CAs in caFile instead of the system pool. The certificate is
+// reloaded when its files change. Any of the files may be empty, but the
+// certificate and key must be given together.
+// Generally only used when create a new Exporter.
+func SetTLSClientFiles(certFile string, keyFile string, caFile string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		if (certFile == "") != (keyFile == "") {
+			return errors.New("tls cert file and key file must be given together")
+		}
+		if certFile != "" {
+			k := &keyPair{certFile: certFile, keyFile: keyFile}
+			if _, err := k.get(); err != nil {
+				return err
+			}
+			e.clientCert = k
+		}
+		if caFile != "" {
+			pem, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				return errors.Wrap(err, "failed to read tls ca file")
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return errors.Errorf("no certificates found in %s", caFile)
+			}
+			e.clientCAs = pool
+		}
+		return nil
+	}
+}
+
+// keyPair is a client certificate that is reloaded when its files change, so
+// that short-lived certificates can be rotated without a restart.
+type keyPair struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// get returns the certificate, loading it again if either file was modified
+// since it was last loaded.
+func (k *keyPair) get() (*tls.Certificate, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var modTime time.Time
+	for _, file := range []string{k.certFile, k.keyFile} {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read client certificate")
+		}
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+	if k.cert != nil && modTime.Equal(k.modTime) {
+		return k.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(k.certFile, k.keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load client certificate")
+	}
+	k.cert = &cert
+	k.modTime = modTime
+	return k.cert, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// config is the configuration file of the exporter, written as YAML. JSON is
+// accepted as well, being valid YAML.
+type config struct {
+	Endpoint         string            `yaml:"endpoint"`
+	Fastcgi          string            `yaml:"fastcgi"`
+	Endpoints        []string          `yaml:"endpoints"`
+	Format           string            `yaml:"format"`
+	FastcgiTimeout   string            `yaml:"fastcgi_timeout"`
+	HTTPTimeout      string            `yaml:"http_timeout"`
+	PoolLabel        *bool             `yaml:"pool_label"`
+	ConstLabels      map[string]string `yaml:"const_labels"`
+	HTTPUser         string            `yaml:"http_user"`
+	HTTPPassword     string            `yaml:"http_password"`
+	HTTPPasswordFile string            `yaml:"http_password_file"`
+	HTTPHeaders      []string          `yaml:"http_headers"`
+	BearerToken      string            `yaml:"bearer_token"`
+	BearerTokenFile  string            `yaml:"bearer_token_file"`
+}
+
+func loadConfig(path string) (*config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open config file")
+	}
+	defer f.Close()
+
+	var c config
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	// an empty file leaves every flag at its default
+	if err := dec.Decode(&c); err != nil && err != io.EOF {
+		return nil, errors.Wrapf(err, "failed to parse config file %s", path)
+	}
+	return &c, nil
+}
+
+// apply sets every flag that was not given on the command line to its value
+// from the config file, so that flags take precedence.
+func (c *config) apply(flags *pflag.FlagSet) error {
+	var labels []string
+	for k, v := range c.ConstLabels {
+		labels = append(labels, k+"="+v)
+	}
+	sort.Strings(labels)
+
+	values := map[string][]string{
+		"endpoint":                  {c.Endpoint},
+		"fastcgi":                   {c.Fastcgi},
+		"phpfpm.endpoints":          c.Endpoints,
+		"phpfpm.format":             {c.Format},
+		"fcgi-timeout":              {c.FastcgiTimeout},
+		"http-timeout":              {c.HTTPTimeout},
+		"phpfpm.const-label":        labels,
+		"phpfpm.http-user":          {c.HTTPUser},
+		"phpfpm.http-password":      {c.HTTPPassword},
+		"phpfpm.http-password-file": {c.HTTPPasswordFile},
+		"phpfpm.http-header":        c.HTTPHeaders,
+		"phpfpm.bearer-token":       {c.BearerToken},
+		"phpfpm.bearer-token-file":  {c.BearerTokenFile},
+	}
+	if c.PoolLabel != nil {
+		values["phpfpm.pool-label"] = []string{strconv.FormatBool(*c.PoolLabel)}
+	}
+
+	for name, vs := range values {
+		if flags.Changed(name) {
+			continue
+		}
+		for _, v := range vs {
+			if v == "" {
+				continue
+			}
+			if err := flags.Set(name, v); err != nil {
+				return errors.Wrapf(err, "invalid value for %s in config file", name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+// writeConfig writes a config file with content to a new directory, removed
+// by the returned function.
+func writeConfig(t *testing.T, name string, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "php-fpm-exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestLoadConfig(t *testing.T) {
+	poolLabel := true
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    *config
+		wantErr bool
+	}{
+		{
+			name: "yaml",
+			file: "config.yml",
+			content: `endpoints:
+  - www=tcp://127.0.0.1:9000/status
+format: json
+pool_label: true
+const_labels:
+  datacenter: fra
+http_headers:
+  - "X-Scrape: 1"
+`,
+			want: &config{
+				Endpoints:   []string{"www=tcp://127.0.0.1:9000/status"},
+				Format:      "json",
+				PoolLabel:   &poolLabel,
+				ConstLabels: map[string]string{"datacenter": "fra"},
+				HTTPHeaders: []string{"X-Scrape: 1"},
+			},
+		},
+		{
+			name:    "json",
+			file:    "config.json",
+			content: `{"endpoint": "http://127.0.0.1:9000/status", "http_timeout": "3s"}`,
+			want:    &config{Endpoint: "http://127.0.0.1:9000/status", HTTPTimeout: "3s"},
+		},
+		{
+			name:    "empty",
+			file:    "config.yml",
+			content: "",
+			want:    &config{},
+		},
+		{
+			name:    "unknown key",
+			file:    "config.yml",
+			content: "endpont: http://127.0.0.1:9000/status\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid yaml",
+			file:    "config.yml",
+			content: "endpoints: [\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, cleanup := writeConfig(t, tt.file, tt.content)
+			defer cleanup()
+
+			c, err := loadConfig(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(c, tt.want) {
+				t.Errorf("config %+v, want %+v", c, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigApply(t *testing.T) {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	endpoint := flags.String("endpoint", "http://127.0.0.1:9000/status", "")
+	format := flags.String("phpfpm.format", "text", "")
+	flags.StringArray("phpfpm.const-label", nil, "")
+	if err := flags.Parse([]string{"--endpoint=http://10.0.0.1:9000/status"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &config{Endpoint: "http://127.0.0.2:9000/status", Format: "json", ConstLabels: map[string]string{"b": "2", "a": "1"}}
+	if err := c.apply(flags); err != nil {
+		t.Fatal(err)
+	}
+	if *endpoint != "http://10.0.0.1:9000/status" {
+		t.Errorf("endpoint %s, want the command line to take precedence", *endpoint)
+	}
+	if *format != "json" {
+		t.Errorf("format %s, want json from the config file", *format)
+	}
+	if labels, _ := flags.GetStringArray("phpfpm.const-label"); !reflect.DeepEqual(labels, []string{"a=1", "b=2"}) {
+		t.Errorf("const labels %q, want sorted labels from the config file", labels)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+// envPrefix is the prefix of the environment variables setting flags.
+const envPrefix = "PHPFPM_"
+
+// envName returns the environment variable for the flag name, e.g.
+// PHPFPM_WEB_LISTEN_ADDRESS for web.listen-address. The phpfpm. prefix of
+// flag names is dropped, so phpfpm.endpoints is PHPFPM_ENDPOINTS.
+func envName(name string) string {
+	name = strings.TrimPrefix(name, "phpfpm.")
+	return envPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(name))
+}
+
+// applyEnv sets every flag not given on the command line from its
+// environment variable, if set.
+func applyEnv(flags *pflag.FlagSet) error {
+	var err error
+	flags.VisitAll(func(f *pflag.Flag) {
+		if err != nil || f.Changed {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if serr := flags.Set(f.Name, value); serr != nil {
+			err = errors.Wrapf(serr, "invalid value for %s", envName(f.Name))
+		}
+	})
+	return err
+}
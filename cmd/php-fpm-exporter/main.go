@@ -3,44 +3,316 @@ package main
 import (
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	exporter "github.com/kublr/php-fpm-exporter"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"go.uber.org/zap"
 )
 
 var (
 	addr         *string
+	listenAddr   *string
+	metricsPath  *string
 	endpoint     *string
 	fcgiEndpoint *string
+	endpoints    *[]string
 	fcgiTimeout  *time.Duration
+	fcgiRead     *time.Duration
+	versionPath  *string
+	keepAlive    *bool
+	proxyProto   *string
+	fcgiPath     *string
+	fcgiQuery    *string
+	fcgiParams   *[]string
+	retries      *int
+	retryDelay   *time.Duration
+	httpTimeout  *time.Duration
+	pushURL      *string
+	pushJob      *string
+	pushInstance *string
+	pushInterval *time.Duration
+	statsdAddr   *string
+	statsdEvery  *time.Duration
+	insecure     *bool
+	format       *string
+	poolLabel    *bool
+	legacy       *bool
+	disabled     *[]string
+	namespace    *string
+	httpUser     *string
+	httpPassword *string
+	passwordFile *string
+	httpHeaders  *[]string
+	bearerToken  *string
+	tokenFile    *string
+	webConfig    *string
+	constLabels  *[]string
+	logFormat    *string
+	buckets      *[]string
+	cacheFor     *time.Duration
+	proxyURL     *string
+	configFile   *string
+	logLevel     *string
+	sdDir        *string
+	sdInterval   *time.Duration
+	endpointList *string
+	dryRun       *bool
+	statusPath   *string
+	shutdown     *time.Duration
+	concurrent   *int
+	zeroStates   *bool
+	pingPath     *string
+	hostHeader   *string
+	scrapeLimit  *time.Duration
+	tlsCert      *string
+	tlsKey       *string
+	tlsCA        *string
+	stickyQueue  *bool
+	maxChildren  *[]string
+	acceptedRate *bool
+	restarts     *bool
+	strictParse  *bool
+	failFast     *bool
+	failures     *int
+	backoff      *time.Duration
+	warmup       *bool
+	warmupLimit  *time.Duration
+	printConfig  *bool
+	noGoMetrics  *bool
+	detailPath   *string
+	detailEvery  *int
 )
 
-func serverCmd(cmd *cobra.Command, args []string) {
+// options builds the exporter options from flags, after applying the
+// environment and the config file if one is given. Flags take precedence over
+// the environment, which takes precedence over the config file.
+func options(flags *pflag.FlagSet) ([]exporter.OptionsFunc, error) {
+	if err := applyEnv(flags); err != nil {
+		return nil, err
+	}
+	if *configFile != "" {
+		c, err := loadConfig(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.apply(flags); err != nil {
+			return nil, err
+		}
+	}
 
-	logger, err := exporter.NewLogger()
-	if err != nil {
-		panic(err)
+	listen := *listenAddr
+	if flags.Changed("addr") {
+		listen = *addr
+	}
+	var warmupFor time.Duration
+	if *warmup {
+		warmupFor = *warmupLimit
 	}
 
-	e, err := exporter.New(
-		exporter.SetAddress(*addr),
+	return []exporter.OptionsFunc{
+		exporter.SetAddress(listen),
+		exporter.SetTelemetryPath(*metricsPath),
 		exporter.SetEndpoint(*endpoint),
 		exporter.SetFastcgi(*fcgiEndpoint),
+		exporter.SetEndpoints(*endpoints),
+		exporter.SetFileSD(*sdDir, *sdInterval),
+		exporter.SetEndpointsFile(*endpointList, *sdInterval),
 		exporter.SetFastcgiTimeout(*fcgiTimeout),
-		exporter.SetLogger(logger),
-	)
+		exporter.SetFastcgiReadTimeout(*fcgiRead),
+		exporter.SetFastcgiKeepAlive(*keepAlive),
+		exporter.SetFastcgiProxyProtocol(*proxyProto),
+		exporter.SetFastcgiPath(*fcgiPath),
+		exporter.SetStatusPath(*statusPath),
+		exporter.SetPingPath(*pingPath),
+		exporter.SetDetailScrape(*detailPath, *detailEvery),
+		exporter.SetFastcgiQuery(*fcgiQuery),
+		exporter.SetFastcgiParams(*fcgiParams),
+		exporter.SetRetries(*retries, *retryDelay),
+		exporter.SetFailureThreshold(*failures, *backoff),
+		exporter.SetScrapeTimeout(*scrapeLimit),
+		exporter.SetMaxConcurrentScrapes(*concurrent),
+		exporter.SetHTTPTimeout(*httpTimeout),
+		exporter.SetInsecureSkipVerify(*insecure),
+		exporter.SetTLSClientFiles(*tlsCert, *tlsKey, *tlsCA),
+		exporter.SetProxyURL(*proxyURL),
+		exporter.SetFormat(*format),
+		exporter.SetStrictParse(*strictParse),
+		exporter.SetPoolLabel(*poolLabel),
+		exporter.SetLegacyMetrics(*legacy),
+		exporter.SetDisabledMetrics(*disabled),
+		exporter.SetZeroProcessStates(*zeroStates),
+		exporter.SetStickyQueueLength(*stickyQueue),
+		exporter.SetMaxChildren(*maxChildren),
+		exporter.SetAcceptedConnectionsRate(*acceptedRate),
+		exporter.SetRestartDetection(*restarts),
+		exporter.SetFailFast(*failFast),
+		exporter.SetWarmup(warmupFor),
+		exporter.SetNamespace(*namespace),
+		exporter.SetConstLabels(*constLabels),
+		exporter.SetRequestDurationBuckets(*buckets),
+		exporter.SetCacheDuration(*cacheFor),
+		exporter.SetVersionScript(*versionPath),
+		exporter.SetBasicAuth(*httpUser, *httpPassword),
+		exporter.SetBasicAuthPasswordFile(*passwordFile),
+		exporter.SetHTTPHeaders(*httpHeaders),
+		exporter.SetHTTPHostHeader(*hostHeader),
+		exporter.SetBearerToken(*bearerToken, *tokenFile),
+		exporter.SetWebConfigFile(*webConfig),
+		exporter.SetShutdownTimeout(*shutdown),
+		exporter.SetExporterMetrics(!*noGoMetrics),
+		exporter.SetPushGateway(*pushURL, *pushJob, *pushInstance, *pushInterval),
+		exporter.SetStatsD(*statsdAddr, *statsdEvery),
+	}, nil
+}
+
+// reload parses the command line again, re-reads the config file and applies
+// the result to e.
+func reload(e *exporter.Exporter) error {
+	flags := pflag.NewFlagSet(os.Args[0], pflag.ContinueOnError)
+	registerFlags(flags)
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		return err
+	}
+	opts, err := options(flags)
+	if err != nil {
+		return err
+	}
+	return e.Reload(opts...)
+}
+
+func serverCmd(cmd *cobra.Command, args []string) {
 
+	if *printConfig {
+		if err := printFlags(cmd.Flags(), os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to print config: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// the log flags may be set from the environment, so the logger can only
+	// be created once the options are loaded
+	opts, err := options(cmd.Flags())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load config: %v\n", err)
+		os.Exit(1)
+	}
+
+	logger, err := exporter.NewLoggerWithConfig(*logFormat, *logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create logger: %v\n", err)
+		os.Exit(1)
+	}
+
+	e, err := exporter.New(append(opts, exporter.SetLogger(logger))...)
 	if err != nil {
 		logger.Fatal("failed to create exporter", zap.Error(err))
 	}
 
+	if *dryRun {
+		if err := e.DryRun(os.Stdout); err != nil {
+			logger.Fatal("dry run failed", zap.Error(err))
+		}
+		return
+	}
+
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for range hupChan {
+			if err := reload(e); err != nil {
+				logger.Error("failed to reload config, keeping the previous one", zap.Error(err))
+				continue
+			}
+			logger.Info("reloaded config")
+		}
+	}()
+
 	if err := e.Run(); err != nil {
 		logger.Fatal("failed to run exporter", zap.Error(err))
 	}
 }
 
+// registerFlags defines all flags on flags.
+func registerFlags(flags *pflag.FlagSet) {
+	configFile = flags.String("config.file", "", "path to a YAML config file. Flags given on the command line take precedence")
+	printConfig = flags.Bool("print-config", false, "print all flags with their defaults and environment variables as JSON and exit")
+	dryRun = flags.Bool("dry-run", false, "scrape all endpoints once, print the parsed status and the metrics, and exit. Exits non-zero if a scrape fails")
+	addr = flags.StringP("addr", "", "127.0.0.1:8080", "listen address for metrics handler")
+	flags.MarkDeprecated("addr", "use --web.listen-address instead")
+	listenAddr = flags.String("web.listen-address", "127.0.0.1:8080", "listen address for metrics handler")
+	metricsPath = flags.String("web.telemetry-path", "/metrics", "path under which to expose metrics")
+	endpoint = flags.StringP("endpoint", "", "http://127.0.0.1:9000/status", "url for php-fpm status")
+	fcgiEndpoint = flags.String("fastcgi", "", "fastcgi url. If this is set, fastcgi will be used instead of HTTP")
+	endpoints = flags.StringSlice("phpfpm.endpoints", nil, "comma separated list of endpoints to scrape, each as url or name=url. If this is set, --endpoint and --fastcgi are ignored")
+	sdDir = flags.String("phpfpm.file-sd-dir", "", "directory of JSON or YAML files in Prometheus file_sd format listing endpoints to scrape. If this is set, --endpoint and --fastcgi are ignored")
+	sdInterval = flags.Duration("phpfpm.file-sd-interval", 30*time.Second, "interval between re-reads of the file_sd directory and the endpoints file")
+	endpointList = flags.String("phpfpm.endpoints-file", "", "text file listing endpoints to scrape, separated by commas or newlines, with # comments. If this is set, --endpoint and --fastcgi are ignored")
+	fcgiTimeout = flags.Duration("fcgi-timeout", 3*time.Second, "fastcgi dial timeout")
+	fcgiRead = flags.Duration("phpfpm.fastcgi-read-timeout", 3*time.Second, "time allowed to read the fastcgi response once connected. 0 disables the limit")
+	keepAlive = flags.Bool("phpfpm.fastcgi-keepalive", false, "reuse the fastcgi connection across scrapes. This keeps one php-fpm worker busy with the exporter")
+	proxyProto = flags.String("phpfpm.proxy-protocol", "", "PROXY protocol version, v1 or v2, whose header is sent on each new fastcgi connection, for php-fpm behind a load balancer requiring it")
+	fcgiPath = flags.String("phpfpm.fastcgi-path", "", "status path requested over fastcgi, overriding the path of the fastcgi url")
+	statusPath = flags.String("phpfpm.status-path", "", "status path for endpoints whose url has no path, for both fastcgi and HTTP (default /status for fastcgi)")
+	pingPath = flags.String("phpfpm.ping-path", "", "ping path, e.g. /ping, requested when the status page is not found or cannot be parsed, exported as phpfpm_ping_up")
+	detailPath = flags.String("phpfpm.detail-path", "", "status path with query, e.g. /status?full, requested for the per-process metrics every --phpfpm.detail-scrape-divisor scrapes")
+	detailEvery = flags.Int("phpfpm.detail-scrape-divisor", 10, "number of scrapes per request of --phpfpm.detail-path")
+	fcgiParams = flags.StringArray("phpfpm.fastcgi-param", nil, "param to send with fastcgi requests as KEY=VALUE, replacing a default of the same name. May be repeated")
+	fcgiQuery = flags.String("phpfpm.fastcgi-query", "", "query string appended to fastcgi requests, e.g. full")
+	concurrent = flags.Int("phpfpm.max-concurrent-scrapes", 16, "maximum number of endpoints scraped at once")
+	scrapeLimit = flags.Duration("phpfpm.scrape-timeout", 0, "maximum time to scrape a single endpoint, including retries. 0 disables the limit")
+	retries = flags.Int("phpfpm.retries", 0, "number of retries for scrapes failing with a network error")
+	failures = flags.Int("phpfpm.failure-threshold", 0, "number of consecutive failed scrapes after which an endpoint is backed off, exporting phpfpm_up 0 without being contacted. 0 disables backing off")
+	backoff = flags.Duration("phpfpm.failure-backoff", time.Minute, "interval between scrapes of a backed off endpoint")
+	retryDelay = flags.Duration("phpfpm.retry-interval", 100*time.Millisecond, "wait before the first retry, doubled for each further retry")
+	versionPath = flags.String("phpfpm.version-script", "", "php script printing PHP_VERSION, requested like the status page to export phpfpm_info")
+	cacheFor = flags.Duration("phpfpm.cache-duration", 0, "reuse the last successful scrape for this long instead of scraping again. 0 disables the cache")
+	httpTimeout = flags.Duration("http-timeout", 3*time.Second, "HTTP scrape timeout")
+	insecure = flags.Bool("phpfpm.insecure-skip-verify", false, "skip TLS certificate verification for https endpoints")
+	tlsCert = flags.String("phpfpm.tls-cert-file", "", "client certificate presented on https scrapes, reloaded when it changes")
+	tlsKey = flags.String("phpfpm.tls-key-file", "", "key of the client certificate")
+	tlsCA = flags.String("phpfpm.tls-ca-file", "", "CA certificates to verify https endpoints with instead of the system pool")
+	proxyURL = flags.String("phpfpm.proxy-url", "", "proxy for HTTP scrapes, overriding HTTP_PROXY and HTTPS_PROXY. NO_PROXY is still honored")
+	format = flags.String("phpfpm.format", "text", "php-fpm status format to request: text, json or xml")
+	strictParse = flags.Bool("phpfpm.strict-parse", false, "split text status lines at the first colon instead of with the regular expression, keeping values that contain colons whole")
+	poolLabel = flags.Bool("phpfpm.pool-label", false, "add a pool label with the pool name reported by php-fpm to every metric")
+	legacy = flags.Bool("phpfpm.emit-legacy-metrics", true, "also emit the deprecated metric names, e.g. phpfpm_accepted_conn")
+	disabled = flags.StringSlice("phpfpm.disable-metric", nil, "name of a metric not to export, e.g. phpfpm_process_requests_total. Can be repeated or given as a comma separated list")
+	zeroStates = flags.Bool("phpfpm.process-states-zero", true, "export phpfpm_process_state_count for all known states, including those no process is in")
+	maxChildren = flags.StringArray("phpfpm.max-children", nil, "pm.max_children of a pool as pool=count, or a count for all pools, exported as phpfpm_max_children. May be repeated")
+	stickyQueue = flags.Bool("phpfpm.sticky-listen-queue-length", false, "keep exporting the last listen queue length of a pool when the status momentarily lacks it")
+	acceptedRate = flags.Bool("phpfpm.accepted-connections-rate", false, "export phpfpm_accepted_connections_per_second, the rate of accepted connections since the previous scrape")
+	restarts = flags.Bool("phpfpm.detect-restarts", false, "export phpfpm_restart_detected_total, counting drops of the uptime of a pool between scrapes")
+	warmup = flags.Bool("phpfpm.warmup", false, "scrape all endpoints in the background at startup until they succeed, holding back /metrics requests until then")
+	warmupLimit = flags.Duration("phpfpm.warmup-timeout", 30*time.Second, "longest time the warm-up waits for the endpoints")
+	failFast = flags.Bool("phpfpm.fail-fast", false, "exit if any endpoint cannot be scraped at startup instead of exporting phpfpm_up 0 until it can")
+	namespace = flags.String("phpfpm.namespace", "phpfpm", "prefix of all metric names")
+	constLabels = flags.StringArray("phpfpm.const-label", nil, "label to add to every metric as name=value. May be repeated")
+	buckets = flags.StringSlice("phpfpm.request-duration-buckets", nil, "comma separated upper bounds in seconds of the request duration histogram buckets (default prometheus.DefBuckets)")
+	httpUser = flags.String("phpfpm.http-user", "", "username for HTTP basic authentication on the status endpoint")
+	httpPassword = flags.String("phpfpm.http-password", "", "password for HTTP basic authentication on the status endpoint")
+	passwordFile = flags.String("phpfpm.http-password-file", "", "file containing the password for HTTP basic authentication")
+	httpHeaders = flags.StringArray("phpfpm.http-header", nil, "header to add to HTTP scrapes as Key:Value. May be repeated")
+	hostHeader = flags.String("phpfpm.http-host-header", "", "Host header of HTTP scrapes, e.g. a virtual host name, while connecting to the host of the endpoint url")
+	bearerToken = flags.String("phpfpm.bearer-token", "", "bearer token for HTTP scrapes")
+	tokenFile = flags.String("phpfpm.bearer-token-file", "", "file containing the bearer token for HTTP scrapes, re-read on every scrape")
+	webConfig = flags.String("web.config.file", "", "path to a web configuration file in YAML enabling TLS or basic auth on the metrics listener")
+	shutdown = flags.Duration("web.shutdown-timeout", 10*time.Second, "time allowed for in-flight requests to finish on SIGINT or SIGTERM")
+	noGoMetrics = flags.Bool("web.disable-exporter-metrics", false, "exclude the go_* and process_* metrics of the exporter itself from /metrics")
+	logFormat = flags.String("log.format", "json", "log encoding: json or console")
+	logLevel = flags.String("log.level", "info", "minimum log level: debug, info, warn or error")
+	pushURL = flags.String("push.gateway-url", "", "pushgateway url. If this is set, metrics are also pushed periodically")
+	pushJob = flags.String("push.job", "php-fpm", "job name used to group pushed metrics")
+	pushInstance = flags.String("push.instance", "", "instance name used to group pushed metrics")
+	pushInterval = flags.Duration("push.interval", 15*time.Second, "interval between pushes to the pushgateway")
+	statsdAddr = flags.String("statsd.address", "", "host:port of a StatsD server. If this is set, the php-fpm metrics are also sent to it over UDP periodically")
+	statsdEvery = flags.Duration("statsd.interval", 15*time.Second, "interval between sends to StatsD")
+}
+
 var rootCmd = &cobra.Command{
 	Use:   "php-fpm-exporter",
 	Short: "php-fpm metrics exporter",
@@ -48,10 +320,7 @@ var rootCmd = &cobra.Command{
 }
 
 func main() {
-	addr = rootCmd.PersistentFlags().StringP("addr", "", "127.0.0.1:8080", "listen address for metrics handler")
-	endpoint = rootCmd.PersistentFlags().StringP("endpoint", "", "http://127.0.0.1:9000/status", "url for php-fpm status")
-	fcgiEndpoint = rootCmd.PersistentFlags().String("fastcgi", "", "fastcgi url. If this is set, fastcgi will be used instead of HTTP")
-	fcgiTimeout = rootCmd.PersistentFlags().Duration("fcgi-timeout", 3*time.Second, "fastcgi dial timeout")
+	registerFlags(rootCmd.PersistentFlags())
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Printf("root command failed: %v", err)
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/spf13/pflag"
+)
+
+// flagInfo describes a flag for --print-config.
+type flagInfo struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Default    string `json:"default"`
+	Env        string `json:"env"`
+	Usage      string `json:"usage"`
+	Deprecated string `json:"deprecated,omitempty"`
+}
+
+// printFlags writes all flags with their defaults and environment variables
+// to w as JSON, sorted by name.
+func printFlags(flags *pflag.FlagSet, w io.Writer) error {
+	infos := []flagInfo{}
+	flags.VisitAll(func(f *pflag.Flag) {
+		infos = append(infos, flagInfo{
+			Name:       f.Name,
+			Type:       f.Value.Type(),
+			Default:    f.DefValue,
+			Env:        envName(f.Name),
+			Usage:      f.Usage,
+			Deprecated: f.Deprecated,
+		})
+	})
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(infos)
+}
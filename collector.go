@@ -1,28 +1,45 @@
 package exporter
 
 import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
-	fcgiclient "github.com/tomasen/fcgi_client"
+	"github.com/prometheus/common/version"
 	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
 )
 
 var (
-	statusLineRegexp = regexp.MustCompile(`(?m)^(.*):\s+(.*)$`)
+	// statusLineRegexp matches a "key: value" line, leaving out trailing
+	// whitespace and the \r of CRLF line endings.
+	statusLineRegexp = regexp.MustCompile(`(?m)^(.*):[ \t]+(.*?)[ \t\r]*$`)
 )
 
 type collector struct {
-	exporter           *Exporter
+	exporter  *Exporter
+	targets   []*target
+	poolLabel bool
+	// targetLabels are the names of the labels of discovered targets.
+	targetLabels       []string
+	legacy             bool
 	up                 *prometheus.Desc
 	acceptedConn       *prometheus.Desc
+	acceptedRate       *prometheus.Desc
 	listenQueue        *prometheus.Desc
 	maxListenQueue     *prometheus.Desc
 	listenQueueLength  *prometheus.Desc
@@ -30,8 +47,53 @@ type collector struct {
 	maxActiveProcesses *prometheus.Desc
 	maxChildrenReached *prometheus.Desc
 	slowRequests       *prometheus.Desc
+	memoryPeak         *prometheus.Desc
+	maxChildren        *prometheus.Desc
 	scrapeFailures     *prometheus.Desc
-	failureCount       int
+	pingUp             *prometheus.Desc
+	httpStatus         *prometheus.Desc
+	httpErrors         *prometheus.Desc
+	saturation         *prometheus.Desc
+	queueUtilization   *prometheus.Desc
+	queuePeakRatio     *prometheus.Desc
+	queueUnlimited     *prometheus.Desc
+	trackedPools       *prometheus.Desc
+	scrapesInFlight    *prometheus.Desc
+	scrapeInterval     *prometheus.Desc
+	endpoints          *prometheus.Desc
+	endpointsUp        *prometheus.Desc
+	lastErrorInfo      *prometheus.Desc
+	processRequests    *prometheus.Desc
+	processMemory      *prometheus.Desc
+	processCPU         *prometheus.Desc
+	processStates      *prometheus.Desc
+	scrapeDuration     *prometheus.Desc
+	fcgiConnect        *prometheus.Desc
+	fcgiRead           *prometheus.Desc
+	processManager     *prometheus.Desc
+	startTime          *prometheus.Desc
+	uptime             *prometheus.Desc
+	restarts           *prometheus.Desc
+	scrapeAttempts     *prometheus.Desc
+	lastSuccess        *prometheus.Desc
+	parseErrors        *prometheus.Desc
+	unexpectedContent  *prometheus.Desc
+	requestDuration    *prometheus.Desc
+	scrapeCancelled    *prometheus.Desc
+	scrapeError        *prometheus.Desc
+	info               *prometheus.Desc
+	bodyBytes          *prometheus.Desc
+	parseDuration      *prometheus.Desc
+	buildInfo          *prometheus.Desc
+
+	// mu protects pools, which is shared by concurrent scrapes, and
+	// lastCollect, the time of the previous collection.
+	mu          sync.Mutex
+	pools       map[string]*poolState
+	lastCollect time.Time
+
+	// disabled holds the Descs of the metrics that are not exported.
+	disabled map[*prometheus.Desc]bool
 
 	oldAcceptedConn       *prometheus.Desc
 	oldListenQueue        *prometheus.Desc
@@ -46,47 +108,169 @@ type collector struct {
 	oldScrapeFailures     *prometheus.Desc
 }
 
+// poolState is the state retained between scrapes for a single pool.
+type poolState struct {
+	saturatedSince time.Time
+	// listenQueueLength is the last listen queue length reported, or -1.
+	listenQueueLength float64
+	// accepted is the accepted connections counter at acceptedAt, and
+	// acceptedRate the rate computed then.
+	accepted     float64
+	acceptedAt   time.Time
+	acceptedRate float64
+	// uptime is the uptime of the previous scrape, or 0, and restarts the
+	// number of times it dropped.
+	uptime   float64
+	restarts int
+}
+
 const metricsNamespace = "phpfpm"
 
-func newFuncMetric(metricName string, docString string, labels []string) *prometheus.Desc {
+func newFuncMetric(namespace string, metricName string, docString string, labels []string, constLabels prometheus.Labels) *prometheus.Desc {
 	return prometheus.NewDesc(
-		prometheus.BuildFQName(metricsNamespace, "", metricName),
-		docString, labels, nil,
+		prometheus.BuildFQName(namespace, "", metricName),
+		docString, labels, constLabels,
 	)
 }
 
-func (e *Exporter) newCollector() *collector {
+// newCollector creates a collector scraping targets. If any target is named
+// or the pool label is enabled, all per-target metrics carry a pool label.
+func (e *Exporter) newCollector(targets []*target) *collector {
+	poolLabel := e.poolLabel
+	for _, t := range targets {
+		if t.name != "" {
+			poolLabel = true
+		}
+	}
+
+	// labels of discovered targets are added to all per-target metrics
+	var targetLabels []string
+	seen := make(map[string]bool)
+	for _, t := range targets {
+		for name := range t.labels {
+			if !seen[name] {
+				seen[name] = true
+				targetLabels = append(targetLabels, name)
+			}
+		}
+	}
+	sort.Strings(targetLabels)
+
+	withPool := func(labels ...string) []string {
+		if !poolLabel {
+			return labels
+		}
+		l := append([]string{"pool"}, targetLabels...)
+		return append(l, labels...)
+	}
+
+	// desc creates the Desc of a metric and records it if it is disabled
+	disabled := make(map[*prometheus.Desc]bool)
+	desc := func(name string, help string, labels []string, constLabels prometheus.Labels) *prometheus.Desc {
+		d := newFuncMetric(e.namespace, name, help, labels, constLabels)
+		if e.disabledMetrics[prometheus.BuildFQName(e.namespace, "", name)] {
+			disabled[d] = true
+		}
+		return d
+	}
+
 	return &collector{
 		exporter:           e,
-		up:                 newFuncMetric("up", "able to contact php-fpm", nil),
-		acceptedConn:       newFuncMetric("accepted_connections_total", "Total number of accepted connections", nil),
-		listenQueue:        newFuncMetric("listen_queue_connections", "Number of connections that have been initiated but not yet accepted", nil),
-		maxListenQueue:     newFuncMetric("listen_queue_max_connections", "Max number of connections the listen queue has reached since FPM start", nil),
-		listenQueueLength:  newFuncMetric("listen_queue_length_connections", "The length of the socket queue, dictating maximum number of pending connections", nil),
-		phpProcesses:       newFuncMetric("processes_total", "process count", []string{"state"}),
-		maxActiveProcesses: newFuncMetric("active_max_processes", "Maximum active process count", nil),
-		maxChildrenReached: newFuncMetric("max_children_reached_total", "Number of times the process limit has been reached", nil),
-		slowRequests:       newFuncMetric("slow_requests_total", "Number of requests that exceed request_slowlog_timeout", nil),
-		scrapeFailures:     newFuncMetric("scrape_failures_total", "Number of errors while scraping php_fpm", nil),
-
-		oldAcceptedConn:       newFuncMetric("accepted_conn", "Total of accepted connections", nil),
-		oldListenQueue:        newFuncMetric("listen_queue", "Number of connections that have been initiated but not yet accepted", nil),
-		oldMaxListenQueue:     newFuncMetric("max_listen_queue", "Max. connections the listen queue has reached since FPM start", nil),
-		oldListenQueueLength:  newFuncMetric("listen_queue_length", "Maximum number of connections that can be queued", nil),
-		oldIdleProcesses:      newFuncMetric("idle_processes", "Idle process count", []string{"state"}),
-		oldActiveProcesses:    newFuncMetric("active_processes", "Active process count", []string{"state"}),
-		oldTotalProcesses:     newFuncMetric("total_processes", "Total process count", nil),
-		oldMaxActiveProcesses: newFuncMetric("max_active_processes", "Maximum active process count", nil),
-		oldMaxChildrenReached: newFuncMetric("max_children_reached", "Number of times the process limit has been reached", nil),
-		oldSlowRequests:       newFuncMetric("slow_requests", "Number of requests that exceed request_slowlog_timeout", nil),
-		oldScrapeFailures:     newFuncMetric("scrape_failures", "Number of errors while scraping php_fpm", nil),
+		targets:            targets,
+		poolLabel:          poolLabel,
+		targetLabels:       targetLabels,
+		legacy:             e.legacyMetrics,
+		disabled:           disabled,
+		up:                 desc("up", "able to contact php-fpm", withPool(), e.constLabels),
+		acceptedConn:       desc("accepted_connections_total", "Total number of accepted connections", withPool(), e.constLabels),
+		acceptedRate:       desc("accepted_connections_per_second", "Accepted connections per second since the previous scrape", withPool(), e.constLabels),
+		listenQueue:        desc("listen_queue_connections", "Number of connections that have been initiated but not yet accepted", withPool(), e.constLabels),
+		maxListenQueue:     desc("listen_queue_max_connections", "Max number of connections the listen queue has reached since FPM start", withPool(), e.constLabels),
+		listenQueueLength:  desc("listen_queue_length_connections", "The length of the socket queue, dictating maximum number of pending connections", withPool(), e.constLabels),
+		phpProcesses:       desc("processes_total", "Number of processes by state: idle, active or total", withPool("state"), e.constLabels),
+		maxActiveProcesses: desc("active_max_processes", "Maximum active process count", withPool(), e.constLabels),
+		maxChildrenReached: desc("max_children_reached_total", "Number of times the process limit has been reached", withPool(), e.constLabels),
+		slowRequests:       desc("slow_requests_total", "Number of requests that exceed request_slowlog_timeout", withPool(), e.constLabels),
+		memoryPeak:         desc("memory_peak_bytes", "Peak memory used by the processes of the pool, if reported by php-fpm", withPool(), e.constLabels),
+		maxChildren:        desc("max_children", "The pm.max_children of the pool, from the status or the configured override", withPool(), e.constLabels),
+		scrapeFailures:     desc("scrape_failures_total", "Number of errors while scraping php_fpm", withPool(), e.constLabels),
+		pingUp:             desc("ping_up", "Whether php-fpm answered on the ping path after the status failed", withPool(), e.constLabels),
+		httpStatus:         desc("http_scrape_status", "HTTP status code of the last scrape, 0 if no response was received", withPool(), e.constLabels),
+		httpErrors:         desc("http_scrape_non_ok_total", "Number of HTTP scrapes answered with a status other than 200", withPool(), e.constLabels),
+		saturation:         desc("sustained_saturation_seconds", "Seconds active processes has continuously equaled max active processes", withPool(), e.constLabels),
+		queueUtilization:   desc("listen_queue_utilization", "Ratio of connections in the listen queue to its length", withPool(), e.constLabels),
+		queuePeakRatio:     desc("listen_queue_peak_ratio", "Ratio of the max listen queue since FPM start to the listen queue length", withPool(), e.constLabels),
+		queueUnlimited:     desc("listen_queue_unlimited", "Whether the listen queue length is reported as 0, i.e. left to the OS default", withPool(), e.constLabels),
+		scrapeInterval:     desc("time_between_scrapes_seconds", "Time since the previous collection of the metrics", nil, e.constLabels),
+		scrapesInFlight:    desc("scrapes_in_flight", "Number of collections of the metrics running at once, including this one", nil, e.constLabels),
+		trackedPools:       desc("exporter_tracked_pools", "Number of pools with state retained between scrapes", nil, e.constLabels),
+		endpoints:          desc("endpoints_total", "Number of configured endpoints", nil, e.constLabels),
+		endpointsUp:        desc("endpoints_up", "Number of endpoints that could be scraped", nil, e.constLabels),
+		lastErrorInfo:      desc("last_error_info", "Category of the error of the last scrape, if it failed", withPool("error"), e.constLabels),
+		processRequests:    desc("process_requests_total", "Number of requests served by the process", withPool("pid"), e.constLabels),
+		processMemory:      desc("process_last_request_memory_bytes", "Max memory used by the last request of the process", withPool("pid"), e.constLabels),
+		processCPU:         desc("process_last_request_cpu", "CPU percentage used by the last request of the process", withPool("pid"), e.constLabels),
+		processStates:      desc("process_state_count", "Number of processes by state from the full status", withPool("state"), e.constLabels),
+		scrapeDuration:     desc("scrape_duration_seconds", "Time taken to fetch the php-fpm status", withPool(), e.constLabels),
+		fcgiConnect:        desc("fastcgi_connect_duration_seconds", "Time taken to connect to php-fpm for the last fastcgi scrape", withPool(), e.constLabels),
+		fcgiRead:           desc("fastcgi_read_duration_seconds", "Time taken from sending the last fastcgi request until the status was read", withPool(), e.constLabels),
+		processManager:     desc("process_manager_info", "The process manager mode of the pool", withPool("mode"), e.constLabels),
+		startTime:          desc("start_time_seconds", "Unix time when the pool was started", withPool(), e.constLabels),
+		uptime:             desc("uptime_seconds", "Number of seconds since the pool was started", withPool(), e.constLabels),
+		restarts:           desc("restart_detected_total", "Number of times the uptime of the pool dropped between scrapes", withPool(), e.constLabels),
+		scrapeAttempts:     desc("scrape_attempts", "Number of attempts made to fetch the php-fpm status", withPool(), e.constLabels),
+		lastSuccess:        desc("last_scrape_success_timestamp_seconds", "Unix time of the last scrape that returned metrics", withPool(), e.constLabels),
+		requestDuration:    desc("request_duration_seconds", "Duration of the requests currently served by the processes", withPool(), e.constLabels),
+		scrapeCancelled:    desc("scrape_cancelled_total", "Number of scrapes aborted because the client went away", withPool(), e.constLabels),
+		scrapeError:        desc("scrape_error", "Whether the last scrape failed for the reason", withPool("reason"), e.constLabels),
+		info:               desc("info", "The php version of the pool", withPool("version"), e.constLabels),
+		bodyBytes:          desc("scrape_body_bytes", "Size of the php-fpm status body", withPool(), e.constLabels),
+		parseDuration:      desc("scrape_parse_duration_seconds", "Time taken to parse the php-fpm status", withPool(), e.constLabels),
+		parseErrors:        desc("scrape_parse_errors_total", "Number of scrapes whose status could not be parsed into any metric", withPool(), e.constLabels),
+		unexpectedContent:  desc("scrape_unexpected_content_total", "Number of scrapes that returned an HTML page instead of the status", withPool(), e.constLabels),
+		buildInfo:          desc("build_info", "Build information of the exporter", []string{"version", "revision", "branch", "goversion"}, e.constLabels),
+		pools:              make(map[string]*poolState),
+
+		oldAcceptedConn:       desc("accepted_conn", "Total of accepted connections", withPool(), e.constLabels),
+		oldListenQueue:        desc("listen_queue", "Number of connections that have been initiated but not yet accepted", withPool(), e.constLabels),
+		oldMaxListenQueue:     desc("max_listen_queue", "Max. connections the listen queue has reached since FPM start", withPool(), e.constLabels),
+		oldListenQueueLength:  desc("listen_queue_length", "Maximum number of connections that can be queued", withPool(), e.constLabels),
+		oldIdleProcesses:      desc("idle_processes", "Idle process count", withPool("state"), e.constLabels),
+		oldActiveProcesses:    desc("active_processes", "Active process count", withPool("state"), e.constLabels),
+		oldTotalProcesses:     desc("total_processes", "Total process count", withPool(), e.constLabels),
+		oldMaxActiveProcesses: desc("max_active_processes", "Maximum active process count", withPool(), e.constLabels),
+		oldMaxChildrenReached: desc("max_children_reached", "Number of times the process limit has been reached", withPool(), e.constLabels),
+		oldSlowRequests:       desc("slow_requests", "Number of requests that exceed request_slowlog_timeout", withPool(), e.constLabels),
+		oldScrapeFailures:     desc("scrape_failures", "Number of errors while scraping php_fpm", withPool(), e.constLabels),
 	}
 }
 
 func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	if len(c.disabled) == 0 {
+		c.describe(ch)
+		return
+	}
+
+	descs := make(chan *prometheus.Desc)
+	go func() {
+		c.describe(descs)
+		close(descs)
+	}()
+	for d := range descs {
+		if !c.disabled[d] {
+			ch <- d
+		}
+	}
+}
+
+func (c *collector) describe(ch chan<- *prometheus.Desc) {
 	ch <- c.up
 	ch <- c.scrapeFailures
+	ch <- c.pingUp
+	ch <- c.httpStatus
+	ch <- c.httpErrors
 	ch <- c.acceptedConn
+	ch <- c.acceptedRate
 	ch <- c.listenQueue
 	ch <- c.maxListenQueue
 	ch <- c.listenQueueLength
@@ -94,6 +278,44 @@ func (c *collector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.maxActiveProcesses
 	ch <- c.maxChildrenReached
 	ch <- c.slowRequests
+	ch <- c.memoryPeak
+	ch <- c.maxChildren
+	ch <- c.saturation
+	ch <- c.queueUtilization
+	ch <- c.queuePeakRatio
+	ch <- c.queueUnlimited
+	ch <- c.trackedPools
+	ch <- c.scrapesInFlight
+	ch <- c.scrapeInterval
+	ch <- c.endpoints
+	ch <- c.endpointsUp
+	ch <- c.lastErrorInfo
+	ch <- c.processRequests
+	ch <- c.processMemory
+	ch <- c.processCPU
+	ch <- c.processStates
+	ch <- c.scrapeDuration
+	ch <- c.fcgiConnect
+	ch <- c.fcgiRead
+	ch <- c.processManager
+	ch <- c.startTime
+	ch <- c.uptime
+	ch <- c.restarts
+	ch <- c.scrapeAttempts
+	ch <- c.lastSuccess
+	ch <- c.parseErrors
+	ch <- c.unexpectedContent
+	ch <- c.requestDuration
+	ch <- c.scrapeCancelled
+	ch <- c.scrapeError
+	ch <- c.info
+	ch <- c.bodyBytes
+	ch <- c.parseDuration
+	ch <- c.buildInfo
+
+	if !c.legacy {
+		return
+	}
 
 	ch <- c.oldAcceptedConn
 	ch <- c.oldListenQueue
@@ -108,45 +330,196 @@ func (c *collector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.oldScrapeFailures
 }
 
-func getDataFastcgi(u *url.URL, timeout time.Duration) ([]byte, error) {
-	path := u.Path
+// defaultFastcgiPort is the port php-fpm listens on by default.
+const defaultFastcgiPort = "9000"
+
+// fastcgiAddress returns the network and address to dial for u and the path of
+// the status page. For unix sockets the url path is the socket, so the status
+// page is always /status. IPv6 hosts are given in brackets as in
+// tcp://[::1]:9000 and the port defaults to 9000.
+func fastcgiAddress(u *url.URL) (network string, address string, path string) {
+	if u.Scheme == "unix" {
+		return "unix", u.Path, "/status"
+	}
+
+	path = u.Path
 	if path == "" {
 		path = "/status"
 	}
+	port := u.Port()
+	if port == "" {
+		port = defaultFastcgiPort
+	}
+	return u.Scheme, net.JoinHostPort(u.Hostname(), port), path
+}
+
+// fastcgiOptions configures the requests of fastcgi scrapes.
+type fastcgiOptions struct {
+	// path overrides the status path of the url.
+	path string
+	// query is appended to the query of the url.
+	query string
+	// params are sent in addition to the default params, replacing those
+	// of the same name.
+	params map[string]string
+}
+
+func getDataFastcgi(ctx context.Context, client *fcgiClient, u *url.URL, format string, opts *fastcgiOptions) ([]byte, fcgiTiming, error) {
+	_, _, path := fastcgiAddress(u)
+	if opts.path != "" {
+		path = opts.path
+	}
 
 	env := map[string]string{
 		"SCRIPT_FILENAME": path,
 		"SCRIPT_NAME":     path,
+		"QUERY_STRING":    statusQuery(u, format, opts.query),
+	}
+	for k, v := range opts.params {
+		env[k] = v
 	}
 
-	fcgi, err := fcgiclient.DialTimeout(u.Scheme, u.Host, timeout)
+	resp, err := client.Get(ctx, env)
 	if err != nil {
-		return nil, errors.Wrap(err, "fastcgi dial failed")
+		return nil, fcgiTiming{}, err
 	}
 
-	defer fcgi.Close()
+	if err := checkStatusCode(resp.StatusCode, "unexpected status"); err != nil {
+		return nil, resp.Timing, err
+	}
 
-	resp, err := fcgi.Get(env)
-	if err != nil {
-		return nil, errors.Wrap(err, "fastcgi get failed")
+	return resp.Body, resp.Timing, nil
+}
+
+// checkStatusCode returns an error with msg unless code is that of a status
+// page. Both transports accept 200, and 0 too as fastcgi responses without a
+// Status header mean 200. A 204 is reported on its own as it usually means
+// the status page is not enabled.
+func checkStatusCode(code int, msg string) error {
+	switch code {
+	case 0, http.StatusOK:
+		return nil
+	case http.StatusNoContent:
+		return &statusCodeError{msg: "status page returned no content", code: code}
 	}
+	return &statusCodeError{msg: msg, code: code}
+}
 
-	defer resp.Body.Close()
+// statusCodeError is returned for a response with an unexpected status code.
+type statusCodeError struct {
+	msg  string
+	code int
+}
 
-	if resp.StatusCode != 200 && resp.StatusCode != 0 {
-		return nil, errors.Errorf("unexpected status: %d", resp.StatusCode)
+func (e *statusCodeError) Error() string {
+	return fmt.Sprintf("%s: %d", e.msg, e.code)
+}
+
+// statusCode returns the status code of err, or 0 if it is not a
+// statusCodeError.
+func statusCode(err error) int {
+	if err, ok := errors.Cause(err).(*statusCodeError); ok {
+		return err.code
 	}
+	return 0
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to read fastcgi body")
+// Values of the reason label of the scrape error metric.
+const (
+	reasonDial       = "dial"
+	reasonTimeout    = "timeout"
+	reasonHTTPStatus = "http_status"
+	reasonParse      = "parse"
+)
+
+var scrapeErrorReasons = []string{reasonDial, reasonTimeout, reasonHTTPStatus, reasonParse}
+
+// scrapeErrorReason classifies an error returned by a scrape. It is empty if
+// the error fits none of the reasons.
+func scrapeErrorReason(err error) string {
+	switch cause := errors.Cause(err).(type) {
+	case *statusCodeError:
+		return reasonHTTPStatus
+	case net.Error:
+		if cause.Timeout() {
+			return reasonTimeout
+		}
+		return reasonDial
 	}
+	return ""
+}
 
-	return body, nil
+// httpOptions configures the requests of HTTP scrapes.
+type httpOptions struct {
+	timeout  time.Duration
+	username string
+	password string
+	headers  http.Header
+	// host is sent as the Host header instead of the host of the url.
+	host string
+	// bearerTokenFile is re-read on every scrape so rotated tokens are used.
+	bearerToken     string
+	bearerTokenFile string
+	// logger warns about charsets of a response that cannot be decoded.
+	logger *zap.Logger
 }
 
-func getDataHTTP(u *url.URL) ([]byte, error) {
-	req := http.Request{
+// authorization returns the bearer token Authorization header value, if any.
+func (o *httpOptions) authorization() (string, error) {
+	token := o.bearerToken
+	if o.bearerTokenFile != "" {
+		b, err := ioutil.ReadFile(o.bearerTokenFile)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to read bearer token file")
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if token == "" {
+		return "", nil
+	}
+	return "Bearer " + token, nil
+}
+
+// requestOptions returns the options for HTTP requests to t. Targets of
+// /probe not matching a configured endpoint get no credentials, so that they
+// are not sent to any host a client names. See also httpClient.
+func (c *collector) requestOptions(t *target) *httpOptions {
+	if !t.anonymous {
+		return &c.exporter.httpOptions
+	}
+	o := c.exporter.httpOptions
+	o.username, o.password = "", ""
+	o.bearerToken, o.bearerTokenFile = "", ""
+	if _, ok := o.headers["Authorization"]; ok {
+		o.headers = make(http.Header)
+		for key, values := range c.exporter.httpOptions.headers {
+			if key != "Authorization" {
+				o.headers[key] = values
+			}
+		}
+	}
+	return &o
+}
+
+// httpClient returns the client for HTTP requests to t, without the client
+// certificate for anonymous targets.
+func (c *collector) httpClient(t *target) *http.Client {
+	if t.anonymous {
+		return c.exporter.probeClient
+	}
+	return c.exporter.httpClient
+}
+
+// getDataHTTP returns the body and the status code of u. The status code is 0
+// if no response was received.
+func getDataHTTP(ctx context.Context, client *http.Client, u *url.URL, opts *httpOptions) ([]byte, int, error) {
+	if opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.timeout)
+		defer cancel()
+	}
+
+	req := &http.Request{
 		Method:     "GET",
 		URL:        u,
 		Proto:      "HTTP/1.1",
@@ -155,74 +528,656 @@ func getDataHTTP(u *url.URL) ([]byte, error) {
 		Header:     make(http.Header),
 		Host:       u.Host,
 	}
+	for key, values := range opts.headers {
+		if key == "Host" {
+			req.Host = values[0]
+			continue
+		}
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	if opts.host != "" {
+		req.Host = opts.host
+	}
+	if opts.username != "" && opts.password != "" {
+		req.SetBasicAuth(opts.username, opts.password)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	auth, err := opts.authorization()
+	if err != nil {
+		return nil, 0, err
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
 
-	resp, err := http.DefaultClient.Do(&req)
+	resp, err := client.Do(req.WithContext(ctx))
 	if err != nil {
-		return nil, errors.Wrap(err, "HTTP request failed")
+		return nil, 0, errors.Wrap(err, "HTTP request failed")
 	}
 
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		return nil, errors.Errorf("unexpected HTTP status: %d", resp.StatusCode)
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, resp.StatusCode, &statusCodeError{msg: "HTTP authentication failed", code: resp.StatusCode}
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+	if err := checkStatusCode(resp.StatusCode, "unexpected HTTP status"); err != nil {
+		return nil, resp.StatusCode, err
+	}
+
+	reader := io.Reader(resp.Body)
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, resp.StatusCode, errors.Wrap(err, "failed to read gzip http body")
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	body, err := ioutil.ReadAll(reader)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to read http body")
+		return nil, resp.StatusCode, errors.Wrap(err, "failed to read http body")
 	}
 
-	return body, nil
+	body, err = toUTF8(body, resp.Header.Get("Content-Type"))
+	if err != nil && opts.logger != nil {
+		opts.logger.Warn("passing php-fpm status through as is", zap.String("target", redact(u.String())), zap.Error(err))
+	}
+	return body, resp.StatusCode, nil
 }
 
 func (c *collector) Collect(ch chan<- prometheus.Metric) {
-	up := 1.0
+	c.collect(context.Background(), ch)
+}
+
+// contextCollector collects with the context of a single scrape request, so
+// that the scrape is aborted when the client goes away.
+type contextCollector struct {
+	*collector
+	ctx context.Context
+}
+
+func (c contextCollector) Collect(ch chan<- prometheus.Metric) {
+	c.collector.collect(c.ctx, ch)
+}
+
+// collect scrapes all targets, aborting the scrapes once ctx is done.
+func (c *collector) collect(ctx context.Context, ch chan<- prometheus.Metric) {
+	if len(c.disabled) > 0 {
+		out, metrics := ch, make(chan prometheus.Metric)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for m := range metrics {
+				if !c.disabled[m.Desc()] {
+					out <- m
+				}
+			}
+		}()
+		defer func() {
+			close(metrics)
+			<-done
+		}()
+		ch = metrics
+	}
+
+	// collections above 1 overlap, e.g. when scraped faster than php-fpm
+	// answers
+	atomic.AddInt64(&c.exporter.scrapesInFlight, 1)
+	defer atomic.AddInt64(&c.exporter.scrapesInFlight, -1)
+
+	var (
+		mu   sync.Mutex
+		seen = make(map[string]bool)
+		up   int
+		g    errgroup.Group
+		// sem bounds the number of targets scraped at once
+		sem = make(chan struct{}, c.exporter.maxConcurrent)
+		// collected holds the metrics of each target, emitted in the order
+		// of the targets rather than of the scrapes finishing
+		collected = make([][]prometheus.Metric, len(c.targets))
+	)
+	for i, t := range c.targets {
+		i, t := i, t
+		sem <- struct{}{}
+		g.Go(func() error {
+			defer func() { <-sem }()
+			var keys []string
+			var ok bool
+			collected[i] = bufferMetrics(func(ch chan<- prometheus.Metric) {
+				keys, ok = c.collectTarget(ctx, ch, t)
+			})
+			mu.Lock()
+			for _, key := range keys {
+				seen[key] = true
+			}
+			if ok {
+				up++
+			}
+			mu.Unlock()
+			return nil
+		})
+	}
+	_ = g.Wait()
+	for _, metrics := range collected {
+		for _, m := range metrics {
+			ch <- m
+		}
+	}
+
+	if c.poolLabel {
+		ch <- prometheus.MustNewConstMetric(
+			c.endpoints,
+			prometheus.GaugeValue,
+			float64(len(c.targets)),
+		)
+		ch <- prometheus.MustNewConstMetric(
+			c.endpointsUp,
+			prometheus.GaugeValue,
+			float64(up),
+		)
+	}
+
+	c.prunePools(seen)
+	c.collectTrackedPools(ch)
+	c.collectScrapeInterval(ch)
+	ch <- prometheus.MustNewConstMetric(
+		c.scrapesInFlight,
+		prometheus.GaugeValue,
+		float64(atomic.LoadInt64(&c.exporter.scrapesInFlight)),
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.buildInfo,
+		prometheus.GaugeValue,
+		1,
+		version.Version, version.Revision, version.Branch, version.GoVersion,
+	)
+}
+
+// bufferMetrics returns the metrics collect sends to its channel.
+func bufferMetrics(collect func(ch chan<- prometheus.Metric)) []prometheus.Metric {
+	var metrics []prometheus.Metric
+	ch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for m := range ch {
+			metrics = append(metrics, m)
+		}
+	}()
+	collect(ch)
+	close(ch)
+	<-done
+	return metrics
+}
+
+// labelValues returns the label values for a metric of t, followed by labels.
+func (c *collector) labelValues(t *target, labels ...string) []string {
+	if !c.poolLabel {
+		return labels
+	}
+	values := []string{t.label(c.exporter.poolLabel)}
+	for _, name := range c.targetLabels {
+		values = append(values, t.labels[name])
+	}
+	return append(values, labels...)
+}
+
+// scrape fetches the raw status of t.
+func (c *collector) scrape(ctx context.Context, t *target) ([]byte, error) {
+	u := withStatusPath(t.url, c.exporter.statusPath)
+	if t.fastcgi {
+		opts := c.exporter.fcgiOptions
+		switch {
+		case t.statusPath != "":
+			opts.path = t.statusPath
+		case u.Scheme == "unix" && opts.path == "":
+			opts.path = c.exporter.statusPath
+		}
+		body, timing, err := getDataFastcgi(ctx, t.fastcgiClient(c.exporter), u, c.exporter.format, &opts)
+		t.fcgiTiming = timing
+		return body, err
+	}
+
+	if t.statusPath != "" {
+		p := *u
+		p.Path = t.statusPath
+		u = &p
+	}
+	body, code, err := getDataHTTP(ctx, c.httpClient(t), withStatusQuery(u, c.exporter.format), c.requestOptions(t))
+	t.httpStatus = code
+	if code != 0 && code != http.StatusOK {
+		t.httpErrors++
+	}
+	return body, err
+}
+
+// scrapeTimeout returns the timeout of a single scrape of t.
+func (c *collector) scrapeTimeout(t *target) time.Duration {
+	if t.fastcgi {
+		return c.exporter.fcgiTimeout
+	}
+	return c.exporter.httpOptions.timeout
+}
+
+// scrapeWithRetry scrapes t, retrying network errors with exponential backoff
+// as long as the total time stays within the scrape timeout, if any. It
+// returns the number of attempts made. Retries stop once ctx is done.
+func (c *collector) scrapeWithRetry(ctx context.Context, t *target) ([]byte, int, error) {
 	var (
-		body []byte
-		err  error
+		timeout  = c.scrapeTimeout(t)
+		deadline = time.Now().Add(timeout)
+		interval = c.exporter.retryInterval
+		attempts = 0
 	)
+	for {
+		attempts++
+		body, err := c.scrape(ctx, t)
+		if err == nil {
+			return body, attempts, nil
+		}
+
+		if _, ok := errors.Cause(err).(net.Error); !ok || attempts > c.exporter.retries || ctx.Err() != nil {
+			return nil, attempts, err
+		}
+		if timeout > 0 && time.Now().Add(interval).After(deadline) {
+			return nil, attempts, err
+		}
 
-	if c.exporter.fcgiEndpoint != nil {
-		body, err = getDataFastcgi(c.exporter.fcgiEndpoint, c.exporter.fcgiTimeout)
+		c.exporter.logger.Debug("retrying scrape", zap.String("target", t.url.String()), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return nil, attempts, err
+		case <-time.After(interval):
+		}
+		interval *= 2
+	}
+}
+
+// collectTarget scrapes t and emits its metrics. It returns the keys of the
+// pool states of t, and false if the scrape failed. A failed scrape returns
+// the keys of the last successful one, as php-fpm being down for a while, e.g.
+// while restarting, must not reset the state of its pools.
+func (c *collector) collectTarget(ctx context.Context, ch chan<- prometheus.Metric, t *target) ([]string, bool) {
+	// scrapes of the same target are serialized as they share its state
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// the context of the client tells its cancellation apart from the
+	// scrape timeout expiring
+	client := ctx
+	if timeout := c.exporter.scrapeTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	up := 1.0
+	start := time.Now()
+	var reason string
+	// ping is set if php-fpm may be alive even though the status failed
+	var ping bool
+	// category describes the error of a failed scrape
+	var category string
+	// snap is the status of a successful scrape
+	var snap *status
+
+	defer func() {
+		t.snapshot.set(snap, start)
+		if category != "" {
+			ch <- prometheus.MustNewConstMetric(
+				c.lastErrorInfo,
+				prometheus.GaugeValue,
+				1,
+				c.labelValues(t, category)...,
+			)
+		}
+		if ping && c.exporter.pingPath != "" {
+			c.collectPing(ctx, ch, t)
+		}
+		for _, r := range scrapeErrorReasons {
+			var v float64
+			if r == reason {
+				v = 1
+			}
+			ch <- prometheus.MustNewConstMetric(
+				c.scrapeError,
+				prometheus.GaugeValue,
+				v,
+				c.labelValues(t, r)...,
+			)
+		}
+		var ts float64
+		if !t.lastSuccess.IsZero() {
+			ts = float64(t.lastSuccess.Unix())
+		}
+		ch <- prometheus.MustNewConstMetric(
+			c.lastSuccess,
+			prometheus.GaugeValue,
+			ts,
+			c.labelValues(t)...,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			c.parseErrors,
+			prometheus.CounterValue,
+			float64(t.parseErrors),
+			c.labelValues(t)...,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			c.unexpectedContent,
+			prometheus.CounterValue,
+			float64(t.htmlBodies),
+			c.labelValues(t)...,
+		)
+	}()
+
+	var (
+		body     []byte
+		attempts int
+		err      error
+		st       *status
+		// warm is the warm-up result served instead of a scrape
+		warm *warmResult
+
+		parseDuration time.Duration
+	)
+	if cache := c.exporter.cacheDuration; cache > 0 && t.cached != nil && start.Sub(t.lastSuccess) < cache {
+		// serve the previous result without contacting php-fpm
+		st = t.cached
+	} else if t.breaker.open(start) {
+		// spare php-fpm the connection attempts until the backoff passed
+		err = errCircuitOpen
 	} else {
-		body, err = getDataHTTP(c.exporter.endpoint)
+		if warm = c.takeWarmup(t, start); warm != nil {
+			// the warm-up just scraped php-fpm, either successfully or
+			// until it gave up
+			body, attempts, err = warm.body, warm.attempts, warm.err
+		} else {
+			body, attempts, err = c.scrapeWithRetry(ctx, t)
+		}
+		if err == nil {
+			if !isText(body) {
+				c.exporter.logger.Warn("php-fpm status is not text", zap.String("target", t.url.String()))
+			}
+			if isUnexpectedContent(c.exporter.format, body) {
+				c.exporter.logger.Warn("php-fpm status looks like an HTML page, check the status path", zap.String("target", t.url.String()))
+				t.htmlBodies++
+			}
+			c.exporter.logger.Debug("php-fpm status", zap.String("target", t.url.String()), zap.ByteString("body", truncateBody(body)))
+			parseStart := time.Now()
+			st, err = parseStatus(c.exporter.format, body, c.exporter.strictParse)
+			parseDuration = time.Since(parseStart)
+			if err != nil {
+				t.parseErrors++
+				reason = reasonParse
+				ping = true
+			}
+		} else {
+			reason = scrapeErrorReason(err)
+			ping = statusCode(err) == http.StatusNotFound
+		}
+	}
+	duration := time.Since(start)
+	if warm != nil {
+		duration = warm.duration
+	}
+	if err == nil {
+		t.statusPool = st.pool()
 	}
 
-	if err != nil {
+	ch <- prometheus.MustNewConstMetric(
+		c.scrapeDuration,
+		prometheus.GaugeValue,
+		duration.Seconds(),
+		c.labelValues(t)...,
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.scrapeAttempts,
+		prometheus.GaugeValue,
+		float64(attempts),
+		c.labelValues(t)...,
+	)
+
+	if t.fastcgi && body != nil {
+		ch <- prometheus.MustNewConstMetric(
+			c.fcgiConnect,
+			prometheus.GaugeValue,
+			t.fcgiTiming.connect.Seconds(),
+			c.labelValues(t)...,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			c.fcgiRead,
+			prometheus.GaugeValue,
+			t.fcgiTiming.read.Seconds(),
+			c.labelValues(t)...,
+		)
+	}
+
+	switch {
+	case err != nil && client.Err() != nil:
+		// the scrape was aborted by the client, php-fpm is not to blame
 		up = 0.0
-		c.exporter.logger.Error("failed to get php-fpm status", zap.Error(err))
-		c.failureCount++
+		c.exporter.logger.Debug("php-fpm scrape cancelled", zap.String("target", t.url.String()), zap.Error(err))
+		t.cancelled++
+		reason = ""
+	case err == errCircuitOpen:
+		up = 0.0
+		reason, category = t.breaker.reason, t.breaker.category
+	case err != nil:
+		up = 0.0
+		c.exporter.logger.Error("failed to get php-fpm status", zap.String("target", t.url.String()), zap.Error(err))
+		t.failureCount++
+		t.lastError.set(err, time.Now())
+		category = errorCategory(err)
+		c.failed(t, reason, category, time.Now())
+	default:
+		c.succeeded(t)
 	}
 	ch <- prometheus.MustNewConstMetric(
 		c.up,
 		prometheus.GaugeValue,
 		up,
+		c.labelValues(t)...,
 	)
 
 	ch <- prometheus.MustNewConstMetric(
 		c.scrapeFailures,
 		prometheus.CounterValue,
-		float64(c.failureCount),
+		float64(t.failureCount),
+		c.labelValues(t)...,
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.scrapeCancelled,
+		prometheus.CounterValue,
+		float64(t.cancelled),
+		c.labelValues(t)...,
 	)
 
-	// dial timeout
-	if err, ok := err.(net.Error); ok && err.Timeout() {
+	if !t.fastcgi {
 		ch <- prometheus.MustNewConstMetric(
-			c.oldActiveProcesses,
+			c.httpStatus,
 			prometheus.GaugeValue,
-			1000.0,
-			"active",
+			float64(t.httpStatus),
+			c.labelValues(t)...,
+		)
+
+		ch <- prometheus.MustNewConstMetric(
+			c.httpErrors,
+			prometheus.CounterValue,
+			float64(t.httpErrors),
+			c.labelValues(t)...,
 		)
 	}
 
 	if up == 0.0 {
-		return
+		return t.poolKeys, false
+	}
+
+	if body != nil {
+		ch <- prometheus.MustNewConstMetric(
+			c.bodyBytes,
+			prometheus.GaugeValue,
+			float64(len(body)),
+			c.labelValues(t)...,
+		)
+	}
+
+	parseStart := time.Now()
+	var keys []string
+	var parsed int
+	switch {
+	case len(st.sections) > 1 && c.poolLabel:
+		// an aggregated status of several pools, emitted per pool
+		names := make(map[string]bool, len(st.sections))
+		for _, section := range st.sections {
+			pool := section.pool()
+			if pool == "" || names[pool] {
+				// the series would collide and fail the whole gather
+				c.exporter.logger.Warn("skipping pool repeated in php-fpm status", zap.String("target", t.url.String()), zap.String("pool", pool))
+				continue
+			}
+			names[pool] = true
+			key, n := c.collectStatus(ch, c.sectionTarget(t, pool), section, st != t.cached)
+			keys = append(keys, key)
+			parsed += n
+		}
+	case len(st.sections) > 1:
+		c.exporter.logger.Warn("php-fpm status holds several pools, enable the pool label to export all of them", zap.String("target", t.url.String()), zap.Int("pools", len(st.sections)))
+		key, n := c.collectStatus(ch, t, st.sections[0], st != t.cached)
+		keys, parsed = []string{key}, n
+	default:
+		key, n := c.collectStatus(ch, t, st, st != t.cached)
+		keys, parsed = []string{key}, n
+	}
+	if body != nil {
+		ch <- prometheus.MustNewConstMetric(
+			c.parseDuration,
+			prometheus.GaugeValue,
+			(parseDuration + time.Since(parseStart)).Seconds(),
+			c.labelValues(t)...,
+		)
+	}
+
+	// a cached status is served with the detail status and version kept
+	// along with it, php-fpm is not contacted for them either
+	fresh := st != t.cached
+	processes := st
+	if c.exporter.detailURL != nil {
+		if fresh {
+			c.scrapeDetail(ctx, t)
+		}
+		if len(st.processes) == 0 && t.detail != nil {
+			processes = t.detail
+		}
+	}
+	c.collectProcesses(ch, t, processes)
+	c.collectVersion(ctx, ch, t, fresh)
+
+	if parsed > 0 {
+		if st != t.cached {
+			t.lastSuccess = time.Now()
+			t.cached = st
+		}
+		snap = st
+		if processes != st {
+			snap = &status{fields: st.fields, processes: processes.processes}
+		}
+	} else {
+		t.parseErrors++
+		reason = reasonParse
+		ping = true
+		category = "no metrics"
+		c.exporter.logger.Debug("no metrics parsed from php-fpm status", zap.String("target", t.url.String()), zap.Int("matches", len(st.fields)), zap.ByteString("body", truncateBody(body)))
 	}
 
-	matches := statusLineRegexp.FindAllStringSubmatch(string(body), -1)
-	for _, match := range matches {
-		key := match[1]
-		value, err := strconv.Atoi(match[2])
+	t.poolKeys = keys
+	return keys, true
+}
+
+// sectionTarget returns a target labelled for the pool section of an aggregated
+// status of t: the pool name, prefixed by the name of t unless that was taken
+// from the status.
+func (c *collector) sectionTarget(t *target, pool string) *target {
+	name := pool
+	if base := t.label(c.exporter.poolLabel); base != "" && base != t.statusPool {
+		name = base + "/" + pool
+	}
+	return &target{name: name, named: true, url: t.url, fastcgi: t.fastcgi, labels: t.labels}
+}
+
+// collectStatus emits the metrics of the pool fields of st, labelled for t. If
+// fresh is not set, st is a cached status. It returns the key of the pool
+// state used and the number of metrics parsed from the fields.
+func (c *collector) collectStatus(ch chan<- prometheus.Metric, t *target, st *status, fresh bool) (string, int) {
+	var (
+		poolName           string
+		parsed             int
+		activeProcesses    = -1.0
+		maxActiveProcesses = -1.0
+		listenQueue        = -1.0
+		maxListenQueue     = -1.0
+		listenQueueLength  = -1.0
+		acceptedConn       = -1.0
+		maxChildren        = -1.0
+		uptime             = -1.0
+		startedAt          time.Time
+	)
+
+	for _, field := range st.fields {
+		key := field.key
+		c.exporter.logger.Debug("status field", zap.String("target", t.url.String()), zap.String("key", key), zap.String("value", field.value))
+
+		// non-numeric fields
+		switch key {
+		case "pool":
+			poolName = field.value
+			continue
+		case "process manager":
+			ch <- prometheus.MustNewConstMetric(
+				c.processManager,
+				prometheus.GaugeValue,
+				1,
+				c.labelValues(t, field.value)...,
+			)
+			continue
+		case "start time":
+			ts, err := parseStartTime(field.value)
+			if err != nil {
+				c.exporter.logger.Debug("failed to parse start time", zap.String("value", field.value), zap.Error(err))
+				continue
+			}
+			startedAt = ts
+			ch <- prometheus.MustNewConstMetric(
+				c.startTime,
+				prometheus.GaugeValue,
+				float64(ts.Unix()),
+				c.labelValues(t)...,
+			)
+			continue
+		case "memory peak":
+			// newer php-fpm versions only; may carry a size suffix
+			peak, err := parseBytes(field.value)
+			if err != nil {
+				c.exporter.logger.Debug("failed to parse memory peak", zap.String("value", field.value), zap.Error(err))
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(
+				c.memoryPeak,
+				prometheus.GaugeValue,
+				peak,
+				c.labelValues(t)...,
+			)
+			parsed++
+			continue
+		}
+
+		value, err := strconv.ParseFloat(field.value, 64)
 		if err != nil {
 			continue
 		}
@@ -231,21 +1186,27 @@ func (c *collector) Collect(ch chan<- prometheus.Metric) {
 		var odesc *prometheus.Desc
 		var valueType prometheus.ValueType
 		labels := []string{}
+		// the old metrics carry the same labels, except for total processes
+		var olabels []string
 
 		switch key {
 		case "accepted conn":
+			acceptedConn = value
 			desc = c.acceptedConn
 			odesc = c.oldAcceptedConn
 			valueType = prometheus.CounterValue
 		case "listen queue":
+			listenQueue = value
 			desc = c.listenQueue
 			odesc = c.oldListenQueue
 			valueType = prometheus.GaugeValue
 		case "max listen queue":
+			maxListenQueue = value
 			desc = c.maxListenQueue
 			odesc = c.oldMaxListenQueue
 			valueType = prometheus.CounterValue
 		case "listen queue len":
+			listenQueueLength = value
 			desc = c.listenQueueLength
 			odesc = c.oldListenQueueLength
 			valueType = prometheus.GaugeValue
@@ -259,7 +1220,9 @@ func (c *collector) Collect(ch chan<- prometheus.Metric) {
 			odesc = c.oldActiveProcesses
 			valueType = prometheus.GaugeValue
 			labels = append(labels, "active")
+			activeProcesses = value
 		case "max active processes":
+			maxActiveProcesses = value
 			desc = c.maxActiveProcesses
 			odesc = c.oldMaxActiveProcesses
 			valueType = prometheus.CounterValue
@@ -272,14 +1235,32 @@ func (c *collector) Collect(ch chan<- prometheus.Metric) {
 			odesc = c.oldSlowRequests
 			valueType = prometheus.CounterValue
 		case "total processes":
+			desc = c.phpProcesses
 			odesc = c.oldTotalProcesses
 			valueType = prometheus.GaugeValue
+			labels = append(labels, "total")
+			olabels = []string{}
+		case "max children":
+			// not reported by stock php-fpm, and overridden by configuration
+			maxChildren = value
+			continue
+		case "start since":
+			uptime = value
+			desc = c.uptime
+			valueType = prometheus.GaugeValue
 		default:
 			continue
 		}
 
+		if !c.legacy {
+			odesc = nil
+		}
+		if olabels == nil {
+			olabels = labels
+		}
+
 		if desc != nil {
-			m, err := prometheus.NewConstMetric(desc, valueType, float64(value), labels...)
+			m, err := prometheus.NewConstMetric(desc, valueType, value, c.labelValues(t, labels...)...)
 			if err != nil {
 				c.exporter.logger.Error(
 					"failed to create metrics",
@@ -290,10 +1271,11 @@ func (c *collector) Collect(ch chan<- prometheus.Metric) {
 			}
 
 			ch <- m
+			parsed++
 		}
 
 		if odesc != nil {
-			m, err := prometheus.NewConstMetric(odesc, valueType, float64(value), labels...)
+			m, err := prometheus.NewConstMetric(odesc, valueType, value, c.labelValues(t, olabels...)...)
 			if err != nil {
 				c.exporter.logger.Error(
 					"failed to create old metrics",
@@ -307,4 +1289,448 @@ func (c *collector) Collect(ch chan<- prometheus.Metric) {
 		}
 
 	}
+
+	key := t.name + "/" + poolName
+	state := c.poolState(key)
+	if c.exporter.stickyQueue {
+		// the queue length is configuration, so keep the series when the
+		// status momentarily lacks it
+		if listenQueueLength >= 0 {
+			state.listenQueueLength = listenQueueLength
+		} else if state.listenQueueLength >= 0 {
+			listenQueueLength = state.listenQueueLength
+			ch <- prometheus.MustNewConstMetric(
+				c.listenQueueLength,
+				prometheus.GaugeValue,
+				listenQueueLength,
+				c.labelValues(t)...,
+			)
+		}
+	}
+	if c.exporter.acceptedRate && acceptedConn >= 0 {
+		// a cached status has no new sample, so repeat the previous rate
+		rate, ok := state.acceptedRate, !state.acceptedAt.IsZero()
+		if fresh {
+			rate, ok = state.updateAcceptedRate(acceptedConn, time.Now())
+		}
+		if ok {
+			ch <- prometheus.MustNewConstMetric(
+				c.acceptedRate,
+				prometheus.GaugeValue,
+				rate,
+				c.labelValues(t)...,
+			)
+		}
+	}
+	if activeProcesses >= 0 && maxActiveProcesses >= 0 {
+		ch <- prometheus.MustNewConstMetric(
+			c.saturation,
+			prometheus.GaugeValue,
+			state.sustainedSaturation(activeProcesses, maxActiveProcesses, time.Now()),
+			c.labelValues(t)...,
+		)
+	}
+
+	// the uptime goes along with the counters so that rate() can tell a
+	// restart of php-fpm from a counter reset
+	if uptime < 0 && !startedAt.IsZero() {
+		uptime = time.Since(startedAt).Seconds()
+		ch <- prometheus.MustNewConstMetric(
+			c.uptime,
+			prometheus.GaugeValue,
+			uptime,
+			c.labelValues(t)...,
+		)
+	}
+	if c.exporter.restarts && uptime >= 0 {
+		ch <- prometheus.MustNewConstMetric(
+			c.restarts,
+			prometheus.CounterValue,
+			float64(state.countRestart(uptime)),
+			c.labelValues(t)...,
+		)
+	}
+
+	if listenQueue >= 0 && listenQueueLength >= 0 {
+		// an empty queue of unknown length is not saturated
+		utilization := 0.0
+		if listenQueueLength > 0 {
+			utilization = listenQueue / listenQueueLength
+		}
+		ch <- prometheus.MustNewConstMetric(
+			c.queueUtilization,
+			prometheus.GaugeValue,
+			utilization,
+			c.labelValues(t)...,
+		)
+	}
+
+	if listenQueueLength >= 0 {
+		// a length of 0 leaves the backlog to the OS, so the ratios to it
+		// are meaningless
+		unlimited := 0.0
+		if listenQueueLength == 0 {
+			unlimited = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			c.queueUnlimited,
+			prometheus.GaugeValue,
+			unlimited,
+			c.labelValues(t)...,
+		)
+	}
+
+	if maxListenQueue >= 0 && listenQueueLength > 0 {
+		ch <- prometheus.MustNewConstMetric(
+			c.queuePeakRatio,
+			prometheus.GaugeValue,
+			maxListenQueue/listenQueueLength,
+			c.labelValues(t)...,
+		)
+	}
+
+	if n, ok := c.configuredMaxChildren(t, poolName); ok {
+		maxChildren = n
+	}
+	if maxChildren >= 0 {
+		ch <- prometheus.MustNewConstMetric(
+			c.maxChildren,
+			prometheus.GaugeValue,
+			maxChildren,
+			c.labelValues(t)...,
+		)
+	}
+	return key, parsed
+}
+
+// configuredMaxChildren returns the max children configured for the pool
+// poolName of t, by pool name, by endpoint name or for all pools.
+func (c *collector) configuredMaxChildren(t *target, poolName string) (float64, bool) {
+	for _, pool := range []string{poolName, t.name} {
+		if pool == "" {
+			continue
+		}
+		if n, ok := c.exporter.maxChildren[pool]; ok {
+			return n, true
+		}
+	}
+	n, ok := c.exporter.maxChildren[""]
+	return n, ok
+}
+
+// versionCacheDuration is how long the php version of a target is reused
+// before the version script is requested again.
+const versionCacheDuration = 10 * time.Minute
+
+// collectVersion emits the php version of t as reported by the version
+// script, if one is configured. Failing to get it only skips the metric. The
+// script is only requested if fetch is set, otherwise the version last got is
+// emitted.
+func (c *collector) collectVersion(ctx context.Context, ch chan<- prometheus.Metric, t *target, fetch bool) {
+	script := c.exporter.versionScript
+	if script == "" {
+		return
+	}
+
+	if fetch && (t.version == "" || time.Since(t.versionAt) > versionCacheDuration) {
+		version, err := c.fetchVersion(ctx, t, script)
+		if err != nil {
+			c.exporter.logger.Warn("failed to get php version", zap.String("target", t.url.String()), zap.Error(err))
+		} else {
+			t.version = version
+			t.versionAt = time.Now()
+		}
+	}
+	if t.version == "" {
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		c.info,
+		prometheus.GaugeValue,
+		1,
+		c.labelValues(t, t.version)...,
+	)
+}
+
+// fetchVersion requests script from t the same way as the status page and
+// returns the first line of its output.
+func (c *collector) fetchVersion(ctx context.Context, t *target, script string) (string, error) {
+	body, err := c.fetchPath(ctx, t, script)
+	if err != nil {
+		return "", err
+	}
+
+	version := strings.TrimSpace(strings.SplitN(string(body), "\n", 2)[0])
+	if version == "" || len(version) > 64 {
+		return "", errors.Errorf("unexpected output of version script: %q", truncateBody(body))
+	}
+	return version, nil
+}
+
+// scrapeDetail fetches the detail status of t every detailDivisor scrapes,
+// starting with the first, and keeps it as t.detail.
+func (c *collector) scrapeDetail(ctx context.Context, t *target) {
+	t.scrapes++
+	if (t.scrapes-1)%c.exporter.detailDivisor != 0 {
+		return
+	}
+
+	d := c.exporter.detailURL
+	u := *t.url
+	u.RawQuery = d.RawQuery
+
+	var body []byte
+	var err error
+	if t.fastcgi {
+		body, _, err = getDataFastcgi(ctx, t.fastcgiClient(c.exporter), &u, c.exporter.format, &fastcgiOptions{path: d.Path, params: c.exporter.fcgiOptions.params})
+	} else {
+		u.Path = d.Path
+		body, _, err = getDataHTTP(ctx, c.httpClient(t), withStatusQuery(&u, c.exporter.format), c.requestOptions(t))
+	}
+	if err != nil {
+		c.exporter.logger.Warn("failed to get php-fpm detail status", zap.String("target", t.url.String()), zap.Error(err))
+		return
+	}
+	st, err := parseStatus(c.exporter.format, body, c.exporter.strictParse)
+	if err != nil {
+		c.exporter.logger.Warn("failed to parse php-fpm detail status", zap.String("target", t.url.String()), zap.Error(err))
+		return
+	}
+	t.detail = st
+}
+
+// fetchPath requests path from t the same way as the status page, without its
+// query.
+func (c *collector) fetchPath(ctx context.Context, t *target, path string) ([]byte, error) {
+	u := *t.url
+	u.RawQuery = ""
+
+	if t.fastcgi {
+		body, _, err := getDataFastcgi(ctx, t.fastcgiClient(c.exporter), &u, formatText, &fastcgiOptions{path: path, params: c.exporter.fcgiOptions.params})
+		return body, err
+	}
+	u.Path = path
+	body, _, err := getDataHTTP(ctx, c.httpClient(t), &u, c.requestOptions(t))
+	return body, err
+}
+
+// collectPing requests the ping path of t and emits whether php-fpm answered.
+func (c *collector) collectPing(ctx context.Context, ch chan<- prometheus.Metric, t *target) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	up := 1.0
+	if _, err := c.fetchPath(ctx, t, c.exporter.pingPath); err != nil {
+		up = 0.0
+		c.exporter.logger.Debug("php-fpm ping failed", zap.String("target", t.url.String()), zap.Error(err))
+	}
+	ch <- prometheus.MustNewConstMetric(
+		c.pingUp,
+		prometheus.GaugeValue,
+		up,
+		c.labelValues(t)...,
+	)
+}
+
+// collectProcesses emits the per-process metrics from the full status output.
+func (c *collector) collectProcesses(ch chan<- prometheus.Metric, t *target, st *status) {
+	processes := st.processes
+	for _, p := range processes {
+		pid := strconv.FormatInt(p.PID, 10)
+		ch <- prometheus.MustNewConstMetric(
+			c.processRequests,
+			prometheus.CounterValue,
+			p.Requests,
+			c.labelValues(t, pid)...,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			c.processMemory,
+			prometheus.GaugeValue,
+			p.LastRequestMemory,
+			c.labelValues(t, pid)...,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			c.processCPU,
+			prometheus.GaugeValue,
+			p.LastRequestCPU,
+			c.labelValues(t, pid)...,
+		)
+	}
+
+	if len(processes) > 0 {
+		c.collectRequestDuration(ch, t, processes)
+		c.collectProcessStates(ch, t, st)
+	}
+}
+
+// collectProcessStates emits the number of processes in each state.
+func (c *collector) collectProcessStates(ch chan<- prometheus.Metric, t *target, st *status) {
+	counts := st.processStateCounts()
+	if c.exporter.zeroStates {
+		for _, state := range knownProcessStates {
+			if _, ok := counts[state]; !ok {
+				counts[state] = 0
+			}
+		}
+	}
+
+	// emitted in a fixed order, known states first and others sorted
+	var states []string
+	for _, state := range knownProcessStates {
+		if _, ok := counts[state]; ok {
+			states = append(states, state)
+		}
+	}
+	var other []string
+	for state := range counts {
+		if !isKnownProcessState(state) {
+			other = append(other, state)
+		}
+	}
+	sort.Strings(other)
+
+	for _, state := range append(states, other...) {
+		ch <- prometheus.MustNewConstMetric(
+			c.processStates,
+			prometheus.GaugeValue,
+			float64(counts[state]),
+			c.labelValues(t, state)...,
+		)
+	}
+}
+
+// isKnownProcessState reports whether state is one of knownProcessStates.
+func isKnownProcessState(state string) bool {
+	for _, known := range knownProcessStates {
+		if state == known {
+			return true
+		}
+	}
+	return false
+}
+
+// collectRequestDuration emits a histogram of the current request durations
+// of all processes that are not idle.
+func (c *collector) collectRequestDuration(ch chan<- prometheus.Metric, t *target, processes []processStatus) {
+	bounds := c.exporter.durationBuckets
+	buckets := make(map[float64]uint64, len(bounds))
+	var count uint64
+	var sum float64
+	for _, p := range processes {
+		if p.State == "Idle" {
+			continue
+		}
+		// php-fpm reports the duration in microseconds
+		d := p.RequestDuration / 1e6
+		count++
+		sum += d
+		for _, b := range bounds {
+			if d <= b {
+				buckets[b]++
+			}
+		}
+	}
+
+	ch <- prometheus.MustNewConstHistogram(
+		c.requestDuration,
+		count,
+		sum,
+		buckets,
+		c.labelValues(t)...,
+	)
+}
+
+// poolState returns the retained state for key, creating it if needed.
+func (c *collector) poolState(key string) *poolState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	state, ok := c.pools[key]
+	if !ok {
+		state = &poolState{listenQueueLength: -1}
+		c.pools[key] = state
+	}
+	return state
+}
+
+// prunePools drops retained state for every pool not in seen, i.e. of targets
+// removed from the configuration and of pools gone from their status.
+func (c *collector) prunePools(seen map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for pool := range c.pools {
+		if !seen[pool] {
+			delete(c.pools, pool)
+		}
+	}
+}
+
+func (c *collector) collectTrackedPools(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	tracked := len(c.pools)
+	c.mu.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(
+		c.trackedPools,
+		prometheus.GaugeValue,
+		float64(tracked),
+	)
+}
+
+// collectScrapeInterval emits the time since the previous collection, which
+// follows the scrape interval of Prometheus. Nothing is emitted for the first.
+func (c *collector) collectScrapeInterval(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	c.mu.Lock()
+	last := c.lastCollect
+	c.lastCollect = now
+	c.mu.Unlock()
+
+	if last.IsZero() {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(
+		c.scrapeInterval,
+		prometheus.GaugeValue,
+		now.Sub(last).Seconds(),
+	)
+}
+
+// sustainedSaturation returns how long active processes has continuously
+// equaled max active processes. It resets once the condition clears.
+func (s *poolState) sustainedSaturation(active float64, maxActive float64, now time.Time) float64 {
+	if active == 0 || active != maxActive {
+		s.saturatedSince = time.Time{}
+		return 0
+	}
+	if s.saturatedSince.IsZero() {
+		s.saturatedSince = now
+	}
+	return now.Sub(s.saturatedSince).Seconds()
+}
+
+// countRestart records uptime and returns the number of restarts seen, counting
+// one whenever uptime is below that of the previous call.
+func (s *poolState) countRestart(uptime float64) int {
+	if uptime < s.uptime {
+		s.restarts++
+	}
+	s.uptime = uptime
+	return s.restarts
+}
+
+// updateAcceptedRate records accepted and returns the rate of accepted
+// connections since the previous call. It returns false on the first call and
+// 0 after a counter reset, e.g. a restart of php-fpm.
+func (s *poolState) updateAcceptedRate(accepted float64, now time.Time) (float64, bool) {
+	first := s.acceptedAt.IsZero()
+	rate := 0.0
+	if elapsed := now.Sub(s.acceptedAt).Seconds(); !first && elapsed > 0 && accepted >= s.accepted {
+		rate = (accepted - s.accepted) / elapsed
+	}
+	s.accepted, s.acceptedAt, s.acceptedRate = accepted, now, rate
+	return rate, !first
 }
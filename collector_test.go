@@ -0,0 +1,931 @@
+package exporter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/version"
+)
+
+// gatherCollector gathers the metrics of the current collector of e.
+func gatherCollector(t testing.TB, e *Exporter) []*dto.MetricFamily {
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(e.currentCollector()); err != nil {
+		t.Fatal(err)
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mfs
+}
+
+// labelValues returns the sorted values of label in the metrics of family.
+func labelValues(mfs []*dto.MetricFamily, family string, label string) []string {
+	var values []string
+	for _, mf := range mfs {
+		if mf.GetName() != family {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == label {
+					values = append(values, l.GetValue())
+				}
+			}
+		}
+	}
+	sort.Strings(values)
+	return values
+}
+
+// serveStatus serves body as the status page of a new php-fpm.
+func serveStatus(body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+}
+
+const section = `pool:                 %s
+process manager:      dynamic
+start since:          100
+accepted conn:        10
+listen queue:         0
+active processes:     1
+`
+
+// poolsStatus is an aggregated status of pools.
+func poolsStatus(pools ...string) string {
+	var body string
+	for i, pool := range pools {
+		if i > 0 {
+			body += "\n"
+		}
+		body += fmt.Sprintf(section, pool)
+	}
+	return body
+}
+
+func TestCollectPoolSections(t *testing.T) {
+	tests := []struct {
+		name  string
+		pools []string
+		want  []string
+	}{
+		{"two pools", []string{"www", "api"}, []string{"api", "www"}},
+		{"duplicate pool", []string{"www", "api", "www"}, []string{"api", "www"}},
+		{"empty pool", []string{"www", ""}, []string{"www"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := serveStatus(poolsStatus(tt.pools...))
+			defer srv.Close()
+
+			e := newTestExporter(t, SetEndpoint(srv.URL+"/status"), SetPoolLabel(true))
+			mfs := gatherCollector(t, e)
+			got := labelValues(mfs, "phpfpm_accepted_connections_total", "pool")
+			if len(got) != len(tt.want) {
+				t.Fatalf("pools %q exported, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("pools %q exported, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// hasFamily reports whether mfs holds the metric family name.
+func hasFamily(mfs []*dto.MetricFamily, name string) bool {
+	for _, mf := range mfs {
+		if mf.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCollectJSONMemoryPeak(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want bool
+	}{
+		{"with memory peak", `{"pool":"www","accepted conn":42,"memory peak":2097152}`, true},
+		{"without memory peak", `{"pool":"www","accepted conn":42}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := serveStatus(tt.body)
+			defer srv.Close()
+
+			e := newTestExporter(t, SetEndpoint(srv.URL+"/status"), SetFormat(formatJSON))
+			mfs := gatherCollector(t, e)
+			if got := hasFamily(mfs, "phpfpm_memory_peak_bytes"); got != tt.want {
+				t.Errorf("phpfpm_memory_peak_bytes exported %v, want %v", got, tt.want)
+			}
+			if hasFamily(mfs, "phpfpm_max_listen_queue") {
+				t.Error("phpfpm_max_listen_queue exported for a status without it")
+			}
+		})
+	}
+}
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// fullStatus is a full text status of pool www with three processes.
+const fullStatus = testStatus + `
+************************
+pid:                  101
+state:                Idle
+start time:           01/Jan/2024:12:00:00 +0000
+start since:          1234
+requests:             20
+request duration:     1500
+request method:       GET
+request URI:          /index.php
+content length:       0
+user:                 -
+script:               /var/www/index.php
+last request cpu:     12.50
+last request memory:  2097152
+
+************************
+pid:                  102
+state:                Running
+start time:           01/Jan/2024:12:00:00 +0000
+start since:          1234
+requests:             15
+request duration:     250000
+request method:       POST
+request URI:          /api.php
+content length:       512
+user:                 -
+script:               /var/www/api.php
+last request cpu:     0.00
+last request memory:  0
+
+************************
+pid:                  103
+state:                Reading headers
+start time:           01/Jan/2024:12:00:00 +0000
+start since:          1234
+requests:             3
+request duration:     100
+request method:       -
+request URI:          -
+content length:       0
+user:                 -
+script:               -
+last request cpu:     0.00
+last request memory:  0
+`
+
+// volatileFamilies are left out of the golden output, as they depend on the
+// time of the scrape or the Go version.
+var volatileFamilies = map[string]bool{
+	"phpfpm_build_info":                            true,
+	"phpfpm_last_scrape_success_timestamp_seconds": true,
+	"phpfpm_scrape_duration_seconds":               true,
+	"phpfpm_scrape_parse_duration_seconds":         true,
+}
+
+func TestCollectGolden(t *testing.T) {
+	srv := serveStatus(fullStatus)
+	defer srv.Close()
+
+	e := newTestExporter(t, SetEndpoint(srv.URL+"/status?full"), SetZeroProcessStates(true))
+	var b bytes.Buffer
+	for _, mf := range gatherCollector(t, e) {
+		if volatileFamilies[mf.GetName()] {
+			continue
+		}
+		if _, err := expfmt.MetricFamilyToText(&b, mf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	golden := filepath.Join("testdata", "full_status.golden")
+	if *update {
+		if err := ioutil.WriteFile(golden, b.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := b.String(); got != string(want) {
+		t.Errorf("metrics differ from %s, run go test -update to update it:\n%s", golden, got)
+	}
+}
+
+func TestCollectProcessStatesOrder(t *testing.T) {
+	e := newTestExporter(t, SetZeroProcessStates(false))
+	c := e.newCollector(e.defaultTargets())
+	st := &status{processes: []processStatus{
+		{State: "Running"}, {State: "Unknown"}, {State: "Idle"}, {State: "Custom"}, {State: "Running"},
+	}}
+	want := []string{"Idle", "Running", "Custom", "Unknown"}
+
+	// the order must not depend on map iteration
+	for i := 0; i < 10; i++ {
+		ch := make(chan prometheus.Metric, 2*len(want))
+		c.collectProcessStates(ch, c.targets[0], st)
+		close(ch)
+		var got []string
+		for m := range ch {
+			var pb dto.Metric
+			if err := m.Write(&pb); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, pb.GetLabel()[0].GetValue())
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("states emitted as %q, want %q", got, want)
+		}
+	}
+}
+
+func TestCollectBuildInfo(t *testing.T) {
+	defer func(v, r, b string) { version.Version, version.Revision, version.Branch = v, r, b }(version.Version, version.Revision, version.Branch)
+	version.Version, version.Revision, version.Branch = "v1.2.3", "abc1234", "master"
+
+	srv := serveStatus(testStatus)
+	defer srv.Close()
+	e := newTestExporter(t, SetEndpoint(srv.URL+"/status"))
+	mfs := gatherCollector(t, e)
+	for label, want := range map[string]string{"version": "v1.2.3", "revision": "abc1234", "branch": "master"} {
+		if got := labelValues(mfs, "phpfpm_build_info", label); len(got) != 1 || got[0] != want {
+			t.Errorf("build_info %s %q, want %q", label, got, want)
+		}
+	}
+}
+
+// scrapeOnce scrapes the first endpoint of e once.
+func scrapeOnce(e *Exporter) ([]byte, error) {
+	c := e.newCollector(e.defaultTargets())
+	t := c.targets[0]
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return c.scrape(context.Background(), t)
+}
+
+func TestCheckStatusCode(t *testing.T) {
+	tests := []struct {
+		code int
+		ok   bool
+		msg  string
+	}{
+		{0, true, ""},
+		{http.StatusOK, true, ""},
+		{http.StatusNoContent, false, "status page returned no content: 204"},
+		{http.StatusUnauthorized, false, "unexpected status: 401"},
+		{http.StatusInternalServerError, false, "unexpected status: 500"},
+	}
+	for _, tt := range tests {
+		err := checkStatusCode(tt.code, "unexpected status")
+		if (err == nil) != tt.ok {
+			t.Errorf("status %d returned error %v, want success %v", tt.code, err, tt.ok)
+			continue
+		}
+		if err != nil && err.Error() != tt.msg {
+			t.Errorf("status %d returned %q, want %q", tt.code, err, tt.msg)
+		}
+	}
+}
+
+func TestScrapeStatusCodes(t *testing.T) {
+	tests := []struct {
+		code int
+		ok   bool
+	}{
+		{http.StatusOK, true},
+		{http.StatusNoContent, false},
+		{http.StatusUnauthorized, false},
+		{http.StatusInternalServerError, false},
+		{http.StatusServiceUnavailable, false},
+	}
+	for _, tt := range tests {
+		handler := func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.code)
+			w.Write([]byte(testStatus))
+		}
+		srv := httptest.NewServer(http.HandlerFunc(handler))
+		l := serveFastcgi(t, "tcp", "127.0.0.1:0", handler)
+		endpoints := map[string]OptionsFunc{
+			"http":    SetEndpoint(srv.URL + "/status"),
+			"fastcgi": SetFastcgi("tcp://" + l.Addr().String() + "/status"),
+		}
+		for transport, endpoint := range endpoints {
+			_, err := scrapeOnce(newTestExporter(t, endpoint))
+			if (err == nil) != tt.ok {
+				t.Errorf("%s status %d returned error %v, want success %v", transport, tt.code, err, tt.ok)
+			}
+			if got := statusCode(err); !tt.ok && got != tt.code {
+				t.Errorf("%s status %d returned error with status %d", transport, tt.code, got)
+			}
+		}
+		srv.Close()
+		l.Close()
+	}
+}
+
+// metricValue returns the value of the first metric of family in mfs whose
+// labels include labels.
+func metricValue(mfs []*dto.MetricFamily, family string, labels ...string) (float64, bool) {
+	for _, mf := range mfs {
+		if mf.GetName() != family {
+			continue
+		}
+	metrics:
+		for _, m := range mf.GetMetric() {
+			for i := 0; i+1 < len(labels); i += 2 {
+				found := false
+				for _, l := range m.GetLabel() {
+					if l.GetName() == labels[i] && l.GetValue() == labels[i+1] {
+						found = true
+					}
+				}
+				if !found {
+					continue metrics
+				}
+			}
+			switch {
+			case m.Gauge != nil:
+				return m.GetGauge().GetValue(), true
+			case m.Counter != nil:
+				return m.GetCounter().GetValue(), true
+			case m.Untyped != nil:
+				return m.GetUntyped().GetValue(), true
+			}
+		}
+	}
+	return 0, false
+}
+
+func TestCollectHTTPTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		sleep    time.Duration
+		timeout  time.Duration
+		up       float64
+		failures float64
+	}{
+		{"answer before the timeout", 0, 2 * time.Second, 1, 0},
+		{"answer after the timeout", 2 * time.Second, 100 * time.Millisecond, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-time.After(tt.sleep):
+				case <-r.Context().Done():
+					return
+				}
+				w.Write([]byte(testStatus))
+			}))
+			defer srv.Close()
+
+			e := newTestExporter(t, SetEndpoint(srv.URL+"/status"), SetHTTPTimeout(tt.timeout))
+			start := time.Now()
+			mfs := gatherCollector(t, e)
+			if d := time.Since(start); d > time.Second {
+				t.Errorf("scrape took %v with a timeout of %v", d, tt.timeout)
+			}
+			if up, _ := metricValue(mfs, "phpfpm_up"); up != tt.up {
+				t.Errorf("phpfpm_up %v, want %v", up, tt.up)
+			}
+			if failures, _ := metricValue(mfs, "phpfpm_scrape_failures_total"); failures != tt.failures {
+				t.Errorf("phpfpm_scrape_failures_total %v, want %v", failures, tt.failures)
+			}
+			if tt.up == 0 {
+				if v, _ := metricValue(mfs, "phpfpm_scrape_error", "reason", reasonTimeout); v != 1 {
+					t.Errorf("phpfpm_scrape_error{reason=%q} %v, want 1", reasonTimeout, v)
+				}
+			}
+		})
+	}
+}
+
+func TestScrapeUnixSocket(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	socket := filepath.Join(dir, "php-fpm.sock")
+
+	scripts := make(chan string, 1)
+	l := serveFastcgi(t, "unix", socket, func(w http.ResponseWriter, r *http.Request) {
+		scripts <- fcgi.ProcessEnv(r)["SCRIPT_FILENAME"]
+		w.Write([]byte(testStatus))
+	})
+	defer l.Close()
+
+	tests := []struct {
+		name     string
+		endpoint string
+		path     string
+		script   string
+	}{
+		{"unix scheme", "unix://" + socket, "", "/status"},
+		{"bare path", socket, "", "/status"},
+		{"status path", "unix://" + socket, "/fpm-status", "/fpm-status"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := scrapeOnce(newTestExporter(t, SetFastcgi(tt.endpoint), SetFastcgiPath(tt.path)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != testStatus {
+				t.Errorf("scraped %q, want %q", body, testStatus)
+			}
+			if script := <-scripts; script != tt.script {
+				t.Errorf("requested %q, want %q", script, tt.script)
+			}
+		})
+	}
+}
+
+func BenchmarkCollectEndpoints(b *testing.B) {
+	var endpoints []string
+	for i := 0; i < 50; i++ {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(5 * time.Millisecond)
+			w.Write([]byte(testStatus))
+		}))
+		defer srv.Close()
+		endpoints = append(endpoints, srv.URL+"/status")
+	}
+
+	tests := []struct {
+		name       string
+		concurrent int
+	}{
+		{"serial", 1},
+		{"concurrent", defaultMaxConcurrent},
+	}
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			e := newTestExporter(b, SetEndpoints(endpoints), SetMaxConcurrentScrapes(tt.concurrent))
+			for i := 0; i < b.N; i++ {
+				gatherCollector(b, e)
+			}
+		})
+	}
+}
+
+func TestScrapeGzip(t *testing.T) {
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte(testStatus))
+	gz.Close()
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		ok       bool
+	}{
+		{"gzip", "gzip", gzipped.Bytes(), true},
+		{"upper case gzip", "GZIP", gzipped.Bytes(), true},
+		{"not encoded", "", []byte(testStatus), true},
+		{"corrupt gzip", "gzip", []byte(testStatus), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accepted := make(chan string, 1)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				accepted <- r.Header.Get("Accept-Encoding")
+				if tt.encoding != "" {
+					w.Header().Set("Content-Encoding", tt.encoding)
+				}
+				w.Write(tt.body)
+			}))
+			defer srv.Close()
+
+			body, err := scrapeOnce(newTestExporter(t, SetEndpoint(srv.URL+"/status")))
+			if (err == nil) != tt.ok {
+				t.Fatalf("scrape returned error %v, want success %v", err, tt.ok)
+			}
+			if tt.ok && string(body) != testStatus {
+				t.Errorf("scraped %q, want %q", body, testStatus)
+			}
+			if a := <-accepted; a != "gzip" {
+				t.Errorf("Accept-Encoding %q sent, want gzip", a)
+			}
+		})
+	}
+}
+
+// Run with -race to check the collector state is guarded.
+func TestCollectConcurrent(t *testing.T) {
+	const collections = 8
+	tests := []struct {
+		name     string
+		code     int
+		up       float64
+		failures float64
+	}{
+		{"up", http.StatusOK, 1, 0},
+		{"down", http.StatusInternalServerError, 0, collections},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(20 * time.Millisecond)
+				w.WriteHeader(tt.code)
+				w.Write([]byte(fullStatus))
+			}))
+			defer srv.Close()
+
+			e := newTestExporter(t, SetEndpoint(srv.URL+"/status?full"), SetPoolLabel(true))
+			c := e.newCollector(e.defaultTargets())
+			e.current = c
+			var wg sync.WaitGroup
+			for i := 0; i < collections; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					ch := make(chan prometheus.Metric)
+					go func() {
+						c.Collect(ch)
+						close(ch)
+					}()
+					for range ch {
+					}
+				}()
+			}
+			wg.Wait()
+
+			mfs := gatherCollector(t, e)
+			if up, _ := metricValue(mfs, "phpfpm_up"); up != tt.up {
+				t.Errorf("phpfpm_up %v, want %v", up, tt.up)
+			}
+			// the gather above failed too
+			want := tt.failures
+			if tt.up == 0 {
+				want++
+			}
+			if failures, _ := metricValue(mfs, "phpfpm_scrape_failures_total"); failures != want {
+				t.Errorf("phpfpm_scrape_failures_total %v after %d concurrent collections, want %v", failures, collections, want)
+			}
+		})
+	}
+}
+
+func TestFastcgiAddress(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		network  string
+		address  string
+		path     string
+	}{
+		{"tcp://127.0.0.1:9001/fpm-status", "tcp", "127.0.0.1:9001", "/fpm-status"},
+		{"tcp://127.0.0.1", "tcp", "127.0.0.1:9000", "/status"},
+		{"tcp://[::1]:9001/status", "tcp", "[::1]:9001", "/status"},
+		{"tcp://[::1]/status", "tcp", "[::1]:9000", "/status"},
+		{"tcp://[fe80::1%25eth0]:9001/status", "tcp", "[fe80::1%eth0]:9001", "/status"},
+		{"unix:///run/php/php-fpm.sock", "unix", "/run/php/php-fpm.sock", "/status"},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.endpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		network, address, path := fastcgiAddress(u)
+		if network != tt.network || address != tt.address || path != tt.path {
+			t.Errorf("fastcgiAddress(%s) = %s, %s, %s, want %s, %s, %s", tt.endpoint, network, address, path, tt.network, tt.address, tt.path)
+		}
+	}
+}
+
+func TestScrapeIPv6(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	defer l.Close()
+	go fcgi.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testStatus))
+	}))
+
+	body, err := scrapeOnce(newTestExporter(t, SetFastcgi("tcp://"+l.Addr().String()+"/status")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != testStatus {
+		t.Errorf("scraped %q, want %q", body, testStatus)
+	}
+}
+
+func TestScrapeFastcgiParams(t *testing.T) {
+	type request struct {
+		method, proto string
+		env           map[string]string
+	}
+	requests := make(chan request, 1)
+	l := serveFastcgi(t, "tcp", "127.0.0.1:0", func(w http.ResponseWriter, r *http.Request) {
+		requests <- request{r.Method, r.Proto, fcgi.ProcessEnv(r)}
+		w.Write([]byte(testStatus))
+	})
+	defer l.Close()
+
+	tests := []struct {
+		name   string
+		params []string
+		proto  string
+		env    map[string]string
+	}{
+		{"defaults", nil, "HTTP/1.1", map[string]string{"SCRIPT_FILENAME": "/status"}},
+		{
+			"extra params",
+			[]string{"DOCUMENT_ROOT=/var/www", "PHP_VALUE=a=b"},
+			"HTTP/1.1",
+			map[string]string{"SCRIPT_FILENAME": "/status", "DOCUMENT_ROOT": "/var/www", "PHP_VALUE": "a=b"},
+		},
+		{
+			"replaced defaults",
+			[]string{"SERVER_PROTOCOL=HTTP/1.0", "SCRIPT_FILENAME=/var/www/status"},
+			"HTTP/1.0",
+			map[string]string{"SCRIPT_FILENAME": "/var/www/status"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestExporter(t, SetFastcgi("tcp://"+l.Addr().String()+"/status"), SetFastcgiParams(tt.params))
+			if _, err := scrapeOnce(e); err != nil {
+				t.Fatal(err)
+			}
+			r := <-requests
+			if r.method != "GET" || r.proto != tt.proto {
+				t.Errorf("requested %s %s, want GET %s", r.method, r.proto, tt.proto)
+			}
+			for key, want := range tt.env {
+				if got := r.env[key]; got != want {
+					t.Errorf("param %s is %q, want %q", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+// stubStatus serves a status page that can be changed between scrapes.
+type stubStatus struct {
+	mu   sync.Mutex
+	code int
+	body string
+}
+
+func (s *stubStatus) set(code int, body string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.code, s.body = code, body
+}
+
+func (s *stubStatus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.WriteHeader(s.code)
+	w.Write([]byte(s.body))
+}
+
+// uptimeStatus is a status of pool www started uptime seconds ago.
+func uptimeStatus(uptime int) string {
+	return fmt.Sprintf("pool:                 www\nstart since:          %d\naccepted conn:        10\nactive processes:     1\n", uptime)
+}
+
+func TestCollectRestartAcrossFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		uptimes []int
+		want    float64
+	}{
+		// 0 is a failed scrape
+		{"restart during outage", []int{1234, 0, 10}, 1},
+		{"restart during long outage", []int{1234, 0, 0, 0, 10}, 1},
+		{"no restart during outage", []int{1234, 0, 1300}, 0},
+		{"restart seen directly", []int{1234, 10}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := &stubStatus{}
+			srv := httptest.NewServer(stub)
+			defer srv.Close()
+
+			e := newTestExporter(t, SetEndpoint(srv.URL+"/status"), SetRestartDetection(true))
+			e.current = e.newCollector(e.defaultTargets())
+			var mfs []*dto.MetricFamily
+			for _, uptime := range tt.uptimes {
+				if uptime == 0 {
+					stub.set(http.StatusInternalServerError, "")
+				} else {
+					stub.set(http.StatusOK, uptimeStatus(uptime))
+				}
+				mfs = gatherCollector(t, e)
+			}
+			if got, _ := metricValue(mfs, "phpfpm_restart_detected_total"); got != tt.want {
+				t.Errorf("phpfpm_restart_detected_total %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCollectTrackedPools(t *testing.T) {
+	a, b := &stubStatus{}, &stubStatus{}
+	srvA, srvB := httptest.NewServer(a), httptest.NewServer(b)
+	defer srvA.Close()
+	defer srvB.Close()
+	both := []string{srvA.URL + "/status", srvB.URL + "/status"}
+
+	// nil pools is a failed scrape
+	steps := []struct {
+		name      string
+		endpoints []string
+		a, b      []string
+		want      float64
+	}{
+		{"two targets", both, []string{"www", "api"}, []string{"shop"}, 3},
+		{"pool added", both, []string{"www", "api", "admin"}, []string{"shop"}, 4},
+		{"pool removed", both, []string{"www", "api"}, []string{"shop"}, 3},
+		{"target failed", both, []string{"www", "api"}, nil, 3},
+		{"all targets failed", both, nil, nil, 3},
+		{"target back", both, []string{"www", "api"}, []string{"shop"}, 3},
+		{"target removed", both[:1], []string{"www", "api"}, []string{"shop"}, 2},
+		{"target added", both, []string{"www", "api"}, []string{"shop", "cart"}, 4},
+	}
+	options := func(endpoints []string) []OptionsFunc {
+		return []OptionsFunc{SetEndpoints(endpoints), SetPoolLabel(true)}
+	}
+	e := newTestExporter(t, options(both)...)
+	e.current = e.newCollector(e.defaultTargets())
+	endpoints := both
+	for _, step := range steps {
+		if len(step.endpoints) != len(endpoints) {
+			if err := e.Reload(options(step.endpoints)...); err != nil {
+				t.Fatal(err)
+			}
+			endpoints = step.endpoints
+		}
+		for _, s := range []struct {
+			stub  *stubStatus
+			pools []string
+		}{{a, step.a}, {b, step.b}} {
+			if s.pools == nil {
+				s.stub.set(http.StatusInternalServerError, "")
+			} else {
+				s.stub.set(http.StatusOK, poolsStatus(s.pools...))
+			}
+		}
+		if got, _ := metricValue(gatherCollector(t, e), "phpfpm_exporter_tracked_pools"); got != step.want {
+			t.Errorf("%s: phpfpm_exporter_tracked_pools %v, want %v", step.name, got, step.want)
+		}
+	}
+}
+
+func TestCollectScrapeTimeout(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	// accepts fastcgi connections but never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				<-done
+				conn.Close()
+			}()
+		}
+	}()
+
+	const timeout = 200 * time.Millisecond
+	tests := []struct {
+		name     string
+		endpoint OptionsFunc
+	}{
+		{"http", SetEndpoint(srv.URL + "/status")},
+		{"fastcgi", SetFastcgi("tcp://" + l.Addr().String() + "/status")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestExporter(t, tt.endpoint, SetScrapeTimeout(timeout), SetHTTPTimeout(time.Minute), SetFastcgiTimeout(time.Minute))
+			start := time.Now()
+			mfs := gatherCollector(t, e)
+			if d := time.Since(start); d > timeout+time.Second {
+				t.Errorf("collection took %v with a scrape timeout of %v", d, timeout)
+			}
+			if up, _ := metricValue(mfs, "phpfpm_up"); up != 0 {
+				t.Errorf("phpfpm_up %v, want 0", up)
+			}
+			if v, _ := metricValue(mfs, "phpfpm_scrape_error", "reason", reasonTimeout); v != 1 {
+				t.Errorf("phpfpm_scrape_error{reason=%q} %v, want 1", reasonTimeout, v)
+			}
+		})
+	}
+}
+
+func TestSustainedSaturation(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	steps := []struct {
+		name      string
+		active    float64
+		maxActive float64
+		elapsed   time.Duration
+		want      float64
+	}{
+		{"below max", 3, 5, 0, 0},
+		{"reaches max", 5, 5, 10 * time.Second, 0},
+		{"stays at max", 5, 5, 25 * time.Second, 15},
+		{"max grows with active", 6, 6, 40 * time.Second, 30},
+		{"clears", 4, 6, 50 * time.Second, 0},
+		{"reaches max again", 6, 6, 60 * time.Second, 0},
+		{"stays at max again", 6, 6, 65 * time.Second, 5},
+		{"idle", 0, 0, 70 * time.Second, 0},
+		{"still idle", 0, 0, 80 * time.Second, 0},
+		{"busy after idle", 2, 2, 90 * time.Second, 0},
+	}
+	var s poolState
+	for _, step := range steps {
+		if got := s.sustainedSaturation(step.active, step.maxActive, start.Add(step.elapsed)); got != step.want {
+			t.Errorf("%s: sustainedSaturation(%v, %v) = %v, want %v", step.name, step.active, step.maxActive, got, step.want)
+		}
+	}
+}
+
+func TestCollectCacheSkipsDetailAndVersion(t *testing.T) {
+	var statusHits, detailHits, versionHits int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/status":
+			atomic.AddInt64(&statusHits, 1)
+			w.Write([]byte(testStatus))
+		case "/status-full":
+			atomic.AddInt64(&detailHits, 1)
+			w.Write([]byte(fullStatus))
+		case "/version.php":
+			atomic.AddInt64(&versionHits, 1)
+			w.Write([]byte("8.2.1\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	e := newTestExporter(t, SetEndpoint(srv.URL+"/status"), SetDetailScrape("/status-full?full", 1),
+		SetVersionScript("/version.php"), SetCacheDuration(time.Minute))
+	e.current = e.newCollector(e.defaultTargets())
+	for i := 0; i < 3; i++ {
+		mfs := gatherCollector(t, e)
+		if _, ok := metricValue(mfs, "phpfpm_info", "version", "8.2.1"); !ok {
+			t.Errorf("scrape %d: no phpfpm_info of version 8.2.1", i)
+		}
+		if !hasFamily(mfs, "phpfpm_process_requests_total") {
+			t.Errorf("scrape %d: no process metrics of the detail status", i)
+		}
+	}
+	for _, c := range []struct {
+		name string
+		hits *int64
+	}{
+		{"status", &statusHits},
+		{"detail status", &detailHits},
+		{"version script", &versionHits},
+	} {
+		if n := atomic.LoadInt64(c.hits); n != 1 {
+			t.Errorf("%s requested %d times within the cache duration, want 1", c.name, n)
+		}
+	}
+}
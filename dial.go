@@ -0,0 +1,37 @@
+package exporter
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// dialFunc connects to address on network, like net.Dialer.DialContext.
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// SetDialer creates a function that will connect to php-fpm with dial instead
+// of a net.Dialer, for fastcgi and HTTP scrapes as well as the readiness
+// check, e.g. to reach php-fpm through a tunnel. The dial timeouts are applied
+// through the context passed to dial.
+// Generally only used when create a new Exporter.
+func SetDialer(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(*Exporter) error {
+	return func(e *Exporter) error {
+		e.dialer = dial
+		return nil
+	}
+}
+
+// dialTimeout connects to address with dial, or a net.Dialer if dial is nil,
+// limiting the dial to timeout if it is set.
+func dialTimeout(ctx context.Context, dial dialFunc, network, address string, timeout time.Duration) (net.Conn, error) {
+	if dial == nil {
+		d := net.Dialer{Timeout: timeout}
+		return d.DialContext(ctx, network, address)
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return dial(ctx, network, address)
+}
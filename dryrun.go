@@ -0,0 +1,63 @@
+package exporter
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// DryRun scrapes all targets once and writes the parsed status fields, as
+// comments, and the resulting metrics in the text exposition format to w. It
+// returns an error if any target could not be scraped or parsed.
+func (e *Exporter) DryRun(w io.Writer) error {
+	targets := e.defaultTargets()
+	if e.discovering() {
+		discovered, err := e.discoverTargets(targets)
+		if err != nil {
+			return err
+		}
+		targets = append(append([]*target{}, targets...), discovered...)
+	}
+
+	c := e.newCollector(targets)
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(c); err != nil {
+		return errors.Wrap(err, "failed to register metrics")
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		return errors.Wrap(err, "failed to gather metrics")
+	}
+
+	for _, t := range c.targets {
+		if t.cached == nil {
+			continue
+		}
+		for _, f := range t.cached.fields {
+			fmt.Fprintf(w, "# %s %s: %s\n", redact(t.url.String()), f.key, f.value)
+		}
+	}
+
+	failed := false
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(w, mf); err != nil {
+			return errors.Wrap(err, "failed to write metrics")
+		}
+
+		for _, m := range mf.GetMetric() {
+			switch mf.GetName() {
+			case e.namespace + "_up":
+				failed = failed || m.GetGauge().GetValue() == 0
+			case e.namespace + "_scrape_error":
+				failed = failed || m.GetGauge().GetValue() == 1
+			}
+		}
+	}
+	if failed {
+		return errors.New("failed to scrape or parse the php-fpm status")
+	}
+	return nil
+}
@@ -2,11 +2,19 @@ package exporter
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -15,16 +23,89 @@ import (
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"golang.org/x/sync/errgroup"
 )
 
 // Exporter handles serving the metrics
 type Exporter struct {
-	addr         string
-	endpoint     *url.URL
-	fcgiEndpoint *url.URL
-	fcgiTimeout  time.Duration
-	logger       *zap.Logger
+	// inFlight is the number of requests being served. It is accessed
+	// atomically and must stay first to be 64-bit aligned.
+	inFlight int64
+	// scrapesInFlight is the number of collections running, accessed
+	// atomically.
+	scrapesInFlight int64
+
+	addr          string
+	metricsPath   string
+	endpoint      *url.URL
+	fcgiEndpoint  *url.URL
+	targets       []*target
+	fcgiTimeout   time.Duration
+	fcgiRead      time.Duration
+	fcgiKeepAlive bool
+	fcgiProxy     int
+	dialer        dialFunc
+	fcgiOptions   fastcgiOptions
+	statusPath    string
+	pingPath      string
+	detailURL     *url.URL
+	detailDivisor int
+	retries       int
+	retryInterval time.Duration
+	scrapeTimeout time.Duration
+	logger        *zap.Logger
+	httpClient    *http.Client
+	probeClient   *http.Client
+	httpOptions   httpOptions
+	insecure      bool
+	format        string
+	poolLabel     bool
+	legacyMetrics bool
+	zeroStates    bool
+	stickyQueue   bool
+	maxChildren   map[string]float64
+	acceptedRate  bool
+	restarts      bool
+	strictParse   bool
+	namespace     string
+	pushURL       *url.URL
+	pushJob       string
+	pushInstance  string
+	pushInterval  time.Duration
+	tlsConfig     *tls.Config
+	authUsers     map[string]string
+	clientCert    *keyPair
+	clientCAs     *x509.CertPool
+	constLabels   prometheus.Labels
+
+	durationBuckets []float64
+	cacheDuration   time.Duration
+	proxyURL        *url.URL
+	versionScript   string
+	sdDir           string
+	endpointsFile   string
+	sdInterval      time.Duration
+	shutdownTimeout time.Duration
+	maxConcurrent   int
+	failFast        bool
+	disabledMetrics map[string]bool
+	statsdAddress   string
+	statsdInterval  time.Duration
+	warmupTimeout   time.Duration
+	exporterMetrics bool
+	// failureThreshold is the number of consecutive failed scrapes after
+	// which an endpoint is only scraped every failureBackoff.
+	failureThreshold int
+	failureBackoff   time.Duration
+	// warmedUp is closed once the warm-up finished, if there is one.
+	warmedUp chan struct{}
+
+	// mu protects current, the collector of the running exporter, and the
+	// targets discovered from sdDir and endpointsFile.
+	mu         sync.RWMutex
+	current    *collector
+	discovered []*target
 }
 
 // OptionsFunc is a function passed to new for setting options on a new Exporter.
@@ -33,7 +114,17 @@ type OptionsFunc func(*Exporter) error
 // New creates an exporter.
 func New(options ...OptionsFunc) (*Exporter, error) {
 	e := &Exporter{
-		addr: ":9090",
+		addr:          ":9090",
+		metricsPath:   "/metrics",
+		format:        formatText,
+		legacyMetrics: true,
+		zeroStates:    true,
+		namespace:     metricsNamespace,
+
+		durationBuckets: prometheus.DefBuckets,
+		shutdownTimeout: 10 * time.Second,
+		maxConcurrent:   defaultMaxConcurrent,
+		exporterMetrics: true,
 	}
 
 	for _, f := range options {
@@ -49,14 +140,90 @@ func New(options ...OptionsFunc) (*Exporter, error) {
 		}
 		e.logger = l
 	}
+	e.httpOptions.logger = e.logger
 
 	if e.endpoint == nil && e.fcgiEndpoint == nil {
 		u, _ := url.Parse("http://localhost:9000/status")
 		e.endpoint = u
 	}
+
+	if len(e.targets) == 0 {
+		if err := e.validateEndpoints(); err != nil {
+			return nil, err
+		}
+	}
+
+	o := e.httpOptions
+	if o.username != "" && o.password != "" && (o.bearerToken != "" || o.bearerTokenFile != "") {
+		return nil, errors.New("basic auth and bearer token are mutually exclusive")
+	}
+
+	e.httpClient = e.newHTTPClient(e.clientCert)
+	e.probeClient = e.newHTTPClient(nil)
 	return e, nil
 }
 
+// newHTTPClient creates the client used for HTTP scrapes, presenting the
+// client certificate k if it is set.
+func (e *Exporter) newHTTPClient(k *keyPair) *http.Client {
+	// the settings of http.DefaultTransport, which cannot be cloned before
+	// Go 1.13
+	transport := &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: e.insecure,
+			RootCAs:            e.clientCAs,
+		},
+	}
+	if k != nil {
+		transport.TLSClientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return k.get()
+		}
+	}
+	if host := e.httpOptions.host; host != "" {
+		// the certificate is that of the virtual host, not of the address
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		transport.TLSClientConfig.ServerName = host
+	}
+	transport.Proxy = e.proxyFunc()
+	if e.dialer != nil {
+		transport.DialContext = e.dialer
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   e.httpOptions.timeout,
+	}
+}
+
+var (
+	httpSchemes    = map[string]bool{"http": true, "https": true}
+	fastcgiSchemes = map[string]bool{"tcp": true, "unix": true}
+)
+
+// validateEndpoints ensures the configured endpoint uses a scheme supported
+// by the transport it will be scraped with and has an address to connect to.
+func (e *Exporter) validateEndpoints() error {
+	if e.fcgiEndpoint != nil {
+		if !fastcgiSchemes[e.fcgiEndpoint.Scheme] {
+			return errors.Errorf("unsupported fastcgi scheme %q in %q: must be tcp or unix", e.fcgiEndpoint.Scheme, e.fcgiEndpoint)
+		}
+		return validateAddress(e.fcgiEndpoint)
+	}
+	if !httpSchemes[e.endpoint.Scheme] {
+		return errors.Errorf("unsupported endpoint scheme %q in %q: must be http or https", e.endpoint.Scheme, e.endpoint)
+	}
+	return validateAddress(e.endpoint)
+}
+
 // SetLogger creates a function that will set the logger.
 // Generally only used when create a new Exporter.
 func SetLogger(l *zap.Logger) func(*Exporter) error {
@@ -79,11 +246,27 @@ func SetAddress(addr string) func(*Exporter) error {
 	}
 }
 
+// SetTelemetryPath creates a function that will set the path metrics are
+// served on.
+// Generally only used when create a new Exporter.
+func SetTelemetryPath(path string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		if !strings.HasPrefix(path, "/") {
+			return errors.Errorf("invalid telemetry path %q: must start with /", path)
+		}
+		e.metricsPath = path
+		return nil
+	}
+}
+
 // SetEndpoint creates a function that will set the URL endpoint to contact
 // php-fpm.
 // Generally only used when create a new Exporter.
 func SetEndpoint(rawurl string) func(*Exporter) error {
 	return func(e *Exporter) error {
+		if rawurl == "" {
+			return nil
+		}
 		u, err := url.Parse(rawurl)
 		if err != nil {
 			return errors.Wrap(err, "failed to parse url")
@@ -93,20 +276,238 @@ func SetEndpoint(rawurl string) func(*Exporter) error {
 	}
 }
 
+// SetEndpoints creates a function that will set multiple endpoints to scrape,
+// each given as url or name=url. The scheme selects fastcgi (tcp, unix) or
+// HTTP (http, https). Every metric carries a pool label with the name, which
+// defaults to the host and path of the url. If this is set, the single
+// endpoint and fastcgi settings are ignored.
+// Generally only used when create a new Exporter.
+func SetEndpoints(endpoints []string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		names := make(map[string]bool)
+		for _, endpoint := range endpoints {
+			t, err := parseNamedTarget(endpoint)
+			if err != nil {
+				return errors.Wrapf(err, "invalid endpoint %q", endpoint)
+			}
+			if names[t.name] {
+				return errors.Errorf("duplicate endpoint name %q", t.name)
+			}
+			names[t.name] = true
+			e.targets = append(e.targets, t)
+		}
+		return nil
+	}
+}
+
 // SetFastcgi creates a function that will set the fastcgi URL endpoint to contact
 // php-fpm. If this is set, then fastcgi is used rather than HTTP.
 // Generally only used when create a new Exporter.
 func SetFastcgi(rawurl string) func(*Exporter) error {
 	return func(e *Exporter) error {
+		if rawurl == "" {
+			return nil
+		}
 		u, err := url.Parse(rawurl)
 		if err != nil {
 			return errors.Wrap(err, "failed to parse url")
 		}
+		// a bare path is a unix socket
+		if u.Scheme == "" && u.Host == "" && u.Path != "" {
+			u.Scheme = "unix"
+		}
 		e.fcgiEndpoint = u
 		return nil
 	}
 }
 
+// SetInsecureSkipVerify creates a function that will disable TLS certificate
+// verification when scraping an https endpoint.
+// Generally only used when create a new Exporter.
+func SetInsecureSkipVerify(insecure bool) func(*Exporter) error {
+	return func(e *Exporter) error {
+		e.insecure = insecure
+		return nil
+	}
+}
+
+// SetFastcgiKeepAlive creates a function that will enable reusing the fastcgi
+// connection across scrapes. Note that php-fpm dedicates a worker to the
+// connection while it is kept open.
+// Generally only used when create a new Exporter.
+func SetFastcgiKeepAlive(enabled bool) func(*Exporter) error {
+	return func(e *Exporter) error {
+		e.fcgiKeepAlive = enabled
+		return nil
+	}
+}
+
+// SetRetries creates a function that will set how often a scrape failing with a
+// network error is retried, waiting interval before the first retry and
+// doubling it afterwards.
+// Generally only used when create a new Exporter.
+func SetRetries(retries int, interval time.Duration) func(*Exporter) error {
+	return func(e *Exporter) error {
+		if retries < 0 {
+			return errors.New("retries must not be negative")
+		}
+		e.retries = retries
+		e.retryInterval = interval
+		return nil
+	}
+}
+
+// SetFastcgiPath creates a function that will set the script path requested
+// from php-fpm, overriding the path of the fastcgi url. This is the only way
+// to change the status path for unix sockets.
+// Generally only used when create a new Exporter.
+func SetFastcgiPath(path string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		e.fcgiOptions.path = path
+		return nil
+	}
+}
+
+// defaultMaxConcurrent is the default number of endpoints scraped at once.
+const defaultMaxConcurrent = 16
+
+// SetMaxConcurrentScrapes creates a function that will set how many endpoints
+// are scraped at once.
+// Generally only used when create a new Exporter.
+func SetMaxConcurrentScrapes(n int) func(*Exporter) error {
+	return func(e *Exporter) error {
+		if n < 1 {
+			return errors.New("max concurrent scrapes must be at least 1")
+		}
+		e.maxConcurrent = n
+		return nil
+	}
+}
+
+// SetScrapeTimeout creates a function that will limit the time taken to scrape
+// a single endpoint, including retries. 0 disables the limit.
+// Generally only used when create a new Exporter.
+func SetScrapeTimeout(timeout time.Duration) func(*Exporter) error {
+	return func(e *Exporter) error {
+		if timeout < 0 {
+			return errors.New("scrape timeout must not be negative")
+		}
+		e.scrapeTimeout = timeout
+		return nil
+	}
+}
+
+// SetShutdownTimeout creates a function that will set how long in-flight
+// requests may take to finish on shutdown.
+// Generally only used when create a new Exporter.
+func SetShutdownTimeout(timeout time.Duration) func(*Exporter) error {
+	return func(e *Exporter) error {
+		if timeout < 0 {
+			return errors.New("shutdown timeout must not be negative")
+		}
+		e.shutdownTimeout = timeout
+		return nil
+	}
+}
+
+// SetExporterMetrics creates a function that will set whether the Go runtime
+// and process metrics of the exporter itself are served on the metrics path.
+// Generally only used when create a new Exporter.
+func SetExporterMetrics(enabled bool) func(*Exporter) error {
+	return func(e *Exporter) error {
+		e.exporterMetrics = enabled
+		return nil
+	}
+}
+
+// SetStatusPath creates a function that will set the status path requested
+// from endpoints whose url has no path, for both fastcgi and HTTP.
+// Generally only used when create a new Exporter.
+func SetStatusPath(path string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		if path != "" && !strings.HasPrefix(path, "/") {
+			return errors.Errorf("status path %q must start with /", path)
+		}
+		e.statusPath = path
+		return nil
+	}
+}
+
+// SetPingPath creates a function that will set the ping path requested when
+// the status page is not found or cannot be parsed.
+// Generally only used when create a new Exporter.
+func SetPingPath(path string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		if path != "" && !strings.HasPrefix(path, "/") {
+			return errors.Errorf("ping path %q must start with /", path)
+		}
+		e.pingPath = path
+		return nil
+	}
+}
+
+// SetDetailScrape creates a function that will request path, e.g.
+// /status?full, in addition to the status every divisor scrapes and export
+// the per-process metrics from it. The processes of the last detail scrape
+// are exported on the scrapes in between. An empty path disables detail
+// scrapes.
+// Generally only used when create a new Exporter.
+func SetDetailScrape(path string, divisor int) func(*Exporter) error {
+	return func(e *Exporter) error {
+		if path == "" {
+			return nil
+		}
+		if !strings.HasPrefix(path, "/") {
+			return errors.Errorf("detail path %q must start with /", path)
+		}
+		if divisor < 1 {
+			return errors.New("detail scrape divisor must be at least 1")
+		}
+		u, err := url.Parse(path)
+		if err != nil {
+			return errors.Wrap(err, "failed to parse detail path")
+		}
+		e.detailURL = u
+		e.detailDivisor = divisor
+		return nil
+	}
+}
+
+// SetFastcgiParams creates a function that will send the params, given as
+// KEY=VALUE, with every fastcgi request, for setups that need more than
+// REQUEST_METHOD, SERVER_PROTOCOL, CONTENT_LENGTH and the script params sent by
+// default. A param replaces the default of the same name.
+// Generally only used when create a new Exporter.
+func SetFastcgiParams(params []string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		for _, param := range params {
+			i := strings.Index(param, "=")
+			if i <= 0 {
+				return errors.Errorf("invalid fastcgi param %q: must be KEY=VALUE", param)
+			}
+			key, value := param[:i], param[i+1:]
+			if _, ok := e.fcgiOptions.params[key]; ok {
+				return errors.Errorf("duplicate fastcgi param %q", key)
+			}
+			if e.fcgiOptions.params == nil {
+				e.fcgiOptions.params = make(map[string]string)
+			}
+			e.fcgiOptions.params[key] = value
+		}
+		return nil
+	}
+}
+
+// SetFastcgiQuery creates a function that will append query to the query
+// string of fastcgi requests, e.g. full for per-process metrics.
+// Generally only used when create a new Exporter.
+func SetFastcgiQuery(query string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		e.fcgiOptions.query = query
+		return nil
+	}
+}
+
 func SetFastcgiTimeout(timeout time.Duration) func(*Exporter) error {
 	return func(e *Exporter) error {
 		e.fcgiTimeout = timeout
@@ -114,40 +515,468 @@ func SetFastcgiTimeout(timeout time.Duration) func(*Exporter) error {
 	}
 }
 
+// SetFastcgiReadTimeout creates a function that will set the time allowed to
+// read the fastcgi response once connected. Zero means no limit.
+// Generally only used when create a new Exporter.
+func SetFastcgiReadTimeout(timeout time.Duration) func(*Exporter) error {
+	return func(e *Exporter) error {
+		e.fcgiRead = timeout
+		return nil
+	}
+}
+
+// SetHTTPTimeout creates a function that will set the timeout for HTTP scrapes.
+// Generally only used when create a new Exporter.
+func SetHTTPTimeout(timeout time.Duration) func(*Exporter) error {
+	return func(e *Exporter) error {
+		e.httpOptions.timeout = timeout
+		return nil
+	}
+}
+
+// SetStrictParse creates a function that will split the lines of the text
+// status at the first colon instead of with the regular expression.
+// Generally only used when create a new Exporter.
+func SetStrictParse(enabled bool) func(*Exporter) error {
+	return func(e *Exporter) error {
+		e.strictParse = enabled
+		return nil
+	}
+}
+
+// SetFormat creates a function that will set the php-fpm status format, either
+// text, json or xml.
+// Generally only used when create a new Exporter.
+func SetFormat(format string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		switch format {
+		case formatText, formatJSON, formatXML:
+			e.format = format
+			return nil
+		default:
+			return errors.Errorf("unsupported status format %q", format)
+		}
+	}
+}
+
+// SetPoolLabel creates a function that will add a pool label carrying the pool
+// name reported by php-fpm to every metric. Explicitly named endpoints keep
+// their configured name.
+// Generally only used when create a new Exporter.
+func SetPoolLabel(enabled bool) func(*Exporter) error {
+	return func(e *Exporter) error {
+		e.poolLabel = enabled
+		return nil
+	}
+}
+
+// SetZeroProcessStates creates a function that will export the process state
+// counts of all known states, including those no process is in.
+// Generally only used when create a new Exporter.
+func SetZeroProcessStates(enabled bool) func(*Exporter) error {
+	return func(e *Exporter) error {
+		e.zeroStates = enabled
+		return nil
+	}
+}
+
+// SetStickyQueueLength creates a function that will export the last listen
+// queue length of a pool on scrapes whose status lacks it.
+// Generally only used when create a new Exporter.
+func SetStickyQueueLength(enabled bool) func(*Exporter) error {
+	return func(e *Exporter) error {
+		e.stickyQueue = enabled
+		return nil
+	}
+}
+
+// SetMaxChildren creates a function that will set the pm.max_children of the
+// pools, exported as phpfpm_max_children in place of a value php-fpm reports.
+// Each entry is either pool=count, where pool is the pool name reported by
+// php-fpm or the name of the endpoint, or a bare count for all other pools.
+// Generally only used when create a new Exporter.
+func SetMaxChildren(values []string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		for _, v := range values {
+			var pool string
+			if i := strings.LastIndex(v, "="); i >= 0 {
+				pool, v = v[:i], v[i+1:]
+			}
+			n, err := strconv.ParseUint(v, 10, 32)
+			if err != nil || n == 0 {
+				return errors.Errorf("invalid max children %q: must be a positive number", v)
+			}
+			if _, ok := e.maxChildren[pool]; ok {
+				return errors.Errorf("duplicate max children for pool %q", pool)
+			}
+			if e.maxChildren == nil {
+				e.maxChildren = make(map[string]float64)
+			}
+			e.maxChildren[pool] = float64(n)
+		}
+		return nil
+	}
+}
+
+// SetAcceptedConnectionsRate creates a function that will export the rate of
+// accepted connections between scrapes, for setups without recording rules.
+// Generally only used when create a new Exporter.
+func SetAcceptedConnectionsRate(enabled bool) func(*Exporter) error {
+	return func(e *Exporter) error {
+		e.acceptedRate = enabled
+		return nil
+	}
+}
+
+// SetRestartDetection creates a function that will export the number of
+// restarts of each pool, detected as drops of its uptime between scrapes.
+// Generally only used when create a new Exporter.
+func SetRestartDetection(enabled bool) func(*Exporter) error {
+	return func(e *Exporter) error {
+		e.restarts = enabled
+		return nil
+	}
+}
+
+// SetLegacyMetrics creates a function that will enable or disable the
+// deprecated metric names kept for backwards compatibility.
+// Generally only used when create a new Exporter.
+func SetLegacyMetrics(enabled bool) func(*Exporter) error {
+	return func(e *Exporter) error {
+		e.legacyMetrics = enabled
+		return nil
+	}
+}
+
+// SetDisabledMetrics creates a function that will exclude the metrics with the
+// given names, e.g. phpfpm_process_requests_total, from Describe and Collect.
+// Generally only used when create a new Exporter.
+func SetDisabledMetrics(names []string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		e.disabledMetrics = make(map[string]bool, len(names))
+		for _, name := range names {
+			if name = strings.TrimSpace(name); name != "" {
+				e.disabledMetrics[name] = true
+			}
+		}
+		return nil
+	}
+}
+
+var namespaceRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// SetNamespace creates a function that will set the prefix of all metric names.
+// Generally only used when create a new Exporter.
+func SetNamespace(namespace string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		if !namespaceRegexp.MatchString(namespace) {
+			return errors.Errorf("invalid metrics namespace %q", namespace)
+		}
+		e.namespace = namespace
+		return nil
+	}
+}
+
+// SetBasicAuth creates a function that will set the credentials for HTTP basic
+// authentication on the status endpoint. They are only used when both are set.
+// Generally only used when create a new Exporter.
+func SetBasicAuth(username string, password string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		e.httpOptions.username = username
+		if password != "" {
+			e.httpOptions.password = password
+		}
+		return nil
+	}
+}
+
+// SetBasicAuthPasswordFile creates a function that will read the HTTP basic
+// authentication password from a file, so it is not visible in the process
+// arguments.
+// Generally only used when create a new Exporter.
+func SetBasicAuthPasswordFile(path string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		if path == "" {
+			return nil
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.Wrap(err, "failed to read password file")
+		}
+		e.httpOptions.password = strings.TrimSpace(string(b))
+		return nil
+	}
+}
+
+// SetBearerToken creates a function that will send token as a bearer token on
+// HTTP scrapes. If file is set, the token is read from it on every scrape
+// instead.
+// Generally only used when create a new Exporter.
+func SetBearerToken(token string, file string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		if token != "" && file != "" {
+			return errors.New("bearer token and bearer token file are mutually exclusive")
+		}
+		e.httpOptions.bearerToken = token
+		e.httpOptions.bearerTokenFile = file
+		return nil
+	}
+}
+
+// SetHTTPHeaders creates a function that will add headers, each given as
+// Key:Value, to every HTTP scrape. Repeated keys are all sent.
+// Generally only used when create a new Exporter.
+func SetHTTPHeaders(headers []string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		for _, header := range headers {
+			i := strings.Index(header, ":")
+			if i <= 0 {
+				return errors.Errorf("invalid header %q: must be Key:Value", header)
+			}
+			if e.httpOptions.headers == nil {
+				e.httpOptions.headers = make(http.Header)
+			}
+			e.httpOptions.headers.Add(strings.TrimSpace(header[:i]), strings.TrimSpace(header[i+1:]))
+		}
+		return nil
+	}
+}
+
+// SetHTTPHostHeader creates a function that will send host as the Host header
+// of HTTP scrapes, while still connecting to the host of the endpoint url. It
+// is also used as the TLS server name.
+// Generally only used when create a new Exporter.
+func SetHTTPHostHeader(host string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		e.httpOptions.host = host
+		return nil
+	}
+}
+
+// SetVersionScript creates a function that will request the php script at
+// path, which must print the php version, and export the version as a metric.
+// The script is requested like the status page, so for fastcgi endpoints path
+// is the script filename and for HTTP endpoints the url path.
+// Generally only used when create a new Exporter.
+func SetVersionScript(path string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		e.versionScript = path
+		return nil
+	}
+}
+
+// SetCacheDuration creates a function that will reuse the status of the last
+// successful scrape of a target for d instead of scraping it again. Zero
+// disables the cache.
+// Generally only used when create a new Exporter.
+func SetCacheDuration(d time.Duration) func(*Exporter) error {
+	return func(e *Exporter) error {
+		if d < 0 {
+			return errors.New("cache duration must not be negative")
+		}
+		e.cacheDuration = d
+		return nil
+	}
+}
+
+// SetRequestDurationBuckets creates a function that will set the upper bounds
+// of the request duration histogram buckets, in seconds.
+// Generally only used when create a new Exporter.
+func SetRequestDurationBuckets(buckets []string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		if len(buckets) == 0 {
+			return nil
+		}
+		bounds := make([]float64, 0, len(buckets))
+		for _, b := range buckets {
+			f, err := strconv.ParseFloat(b, 64)
+			if err != nil {
+				return errors.Wrapf(err, "invalid bucket %q", b)
+			}
+			if len(bounds) > 0 && f <= bounds[len(bounds)-1] {
+				return errors.Errorf("buckets must be in increasing order: %v", buckets)
+			}
+			bounds = append(bounds, f)
+		}
+		e.durationBuckets = bounds
+		return nil
+	}
+}
+
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// SetConstLabels creates a function that will add labels, each given as
+// name=value, to every metric.
+// Generally only used when create a new Exporter.
+func SetConstLabels(labels []string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		for _, label := range labels {
+			i := strings.Index(label, "=")
+			if i < 0 {
+				return errors.Errorf("invalid label %q: must be name=value", label)
+			}
+			name, value := label[:i], label[i+1:]
+			if !labelNameRegexp.MatchString(name) || strings.HasPrefix(name, "__") {
+				return errors.Errorf("invalid label name %q", name)
+			}
+			if _, ok := e.constLabels[name]; ok {
+				return errors.Errorf("duplicate label %q", name)
+			}
+			if e.constLabels == nil {
+				e.constLabels = make(prometheus.Labels)
+			}
+			e.constLabels[name] = value
+		}
+		return nil
+	}
+}
+
 var healthzOK = []byte("ok\n")
 
+// readyTimeout bounds the dial of each target in the readiness check.
+const readyTimeout = 2 * time.Second
+
 func (e *Exporter) healthz(w http.ResponseWriter, r *http.Request) {
 	w.Write(healthzOK)
 }
 
+// ready reports whether all targets accept connections. It only dials the
+// targets and does not request the status page.
+func (e *Exporter) ready(w http.ResponseWriter, r *http.Request) {
+	for _, t := range e.currentCollector().targets {
+		network, address := t.dialAddress()
+		conn, err := dialTimeout(context.Background(), e.dialer, network, address, readyTimeout)
+		if err != nil {
+			e.logger.Debug("target is not ready", zap.String("target", redact(t.url.String())), zap.Error(err))
+			http.Error(w, "target "+redact(t.url.String())+" is not reachable", http.StatusServiceUnavailable)
+			return
+		}
+		conn.Close()
+	}
+	w.Write(healthzOK)
+}
+
+// metricsHandler serves the metrics of the current collector along with those
+// of the default registry. The scrape is cancelled when the request is.
+func (e *Exporter) metricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if e.warmedUp != nil {
+			// a target still in its last warm-up scrape is collected once
+			// that scrape finished, from its result
+			timer := time.NewTimer(e.warmupTimeout)
+			select {
+			case <-e.warmedUp:
+			case <-timer.C:
+			case <-r.Context().Done():
+				timer.Stop()
+				return
+			}
+			timer.Stop()
+		}
+
+		reg := prometheus.NewRegistry()
+		if err := reg.Register(contextCollector{e.currentCollector(), r.Context()}); err != nil {
+			e.logger.Error("failed to register metrics", zap.Error(err))
+			http.Error(w, "failed to register metrics", http.StatusInternalServerError)
+			return
+		}
+		promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, reg}, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+}
+
+// gather collects the metrics of the current collector along with those of
+// the default registry.
+func (e *Exporter) gather() ([]*dto.MetricFamily, error) {
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(e.currentCollector()); err != nil {
+		return nil, errors.Wrap(err, "failed to register metrics")
+	}
+	return prometheus.Gatherers{prometheus.DefaultGatherer, reg}.Gather()
+}
+
+// countInFlight wraps h to keep track of the number of requests being served.
+func (e *Exporter) countInFlight(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&e.inFlight, 1)
+		defer atomic.AddInt64(&e.inFlight, -1)
+		h.ServeHTTP(w, r)
+	})
+}
+
 // Run starts the http server and collecting metrics. It generally does not return.
 func (e *Exporter) Run() error {
 
-	c := e.newCollector()
-	if err := prometheus.Register(c); err != nil {
+	c := e.newCollector(e.defaultTargets())
+	if err := prometheus.NewRegistry().Register(c); err != nil {
 		return errors.Wrap(err, "failed to register metrics")
 	}
-	prometheus.Unregister(prometheus.NewProcessCollector(os.Getpid(), ""))
-	prometheus.Unregister(prometheus.NewGoCollector())
+	e.mu.Lock()
+	e.current = c
+	e.mu.Unlock()
+	if e.discovering() {
+		e.refreshTargets()
+	}
+	if err := e.checkStartup(); err != nil {
+		return err
+	}
+	if e.warmupTimeout > 0 {
+		e.warmedUp = make(chan struct{})
+		go e.warmUp(e.warmedUp)
+	}
+	if !e.exporterMetrics {
+		prometheus.Unregister(prometheus.NewProcessCollector(os.Getpid(), ""))
+		prometheus.Unregister(prometheus.NewGoCollector())
+	}
 
+	http.HandleFunc("/", e.landing)
 	http.HandleFunc("/healthz", e.healthz)
-	http.Handle("/metrics", promhttp.Handler())
-	stopChan := make(chan os.Signal)
+	http.HandleFunc("/-/ready", e.ready)
+	http.HandleFunc("/-/lasterror", e.serveLastError)
+	http.HandleFunc("/status.json", e.serveStatusJSON)
+	http.Handle(e.metricsPath, e.metricsHandler())
+	http.HandleFunc("/probe", e.probe)
+	stopChan := make(chan os.Signal, 1)
 	signal.Notify(stopChan, syscall.SIGINT, syscall.SIGTERM)
 
-	srv := &http.Server{Addr: e.addr}
+	srv := &http.Server{Addr: e.addr, Handler: e.countInFlight(e.authenticate(http.DefaultServeMux)), TLSConfig: e.tlsConfig}
 	var g errgroup.Group
 
+	pushCtx, stopPush := context.WithCancel(context.Background())
+	defer stopPush()
+	if e.pushURL != nil {
+		g.Go(func() error {
+			return e.runPush(pushCtx, prometheus.GathererFunc(e.gather))
+		})
+	}
+	if e.discovering() {
+		g.Go(func() error {
+			return e.runFileSD(pushCtx)
+		})
+	}
+	if e.statsdAddress != "" {
+		g.Go(func() error {
+			return e.runStatsD(pushCtx)
+		})
+	}
+
 	g.Go(func() error {
-		// TODO: allow TLS
+		if srv.TLSConfig != nil {
+			return srv.ListenAndServeTLS("", "")
+		}
 		return srv.ListenAndServe()
 	})
 	g.Go(func() error {
 		<-stopChan
-		// XXX: should shutdown time be configurable?
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		stopPush()
+		inFlight := atomic.LoadInt64(&e.inFlight)
+		e.logger.Info("shutting down", zap.Int64("in_flight", inFlight), zap.Duration("timeout", e.shutdownTimeout))
+		ctx, cancel := context.WithTimeout(context.Background(), e.shutdownTimeout)
 		defer cancel()
-		_ = srv.Shutdown(ctx)
+		if err := srv.Shutdown(ctx); err != nil {
+			e.logger.Warn("in-flight requests did not finish before the shutdown timeout", zap.Int64("remaining", atomic.LoadInt64(&e.inFlight)), zap.Error(err))
+			return nil
+		}
+		e.logger.Info("drained in-flight requests", zap.Int64("drained", inFlight))
 		return nil
 	})
 
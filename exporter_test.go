@@ -0,0 +1,150 @@
+package exporter
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestHTTPSInsecureSkipVerify(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testStatus))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		insecure bool
+		ok       bool
+	}{
+		{false, false},
+		{true, true},
+	}
+	for _, tt := range tests {
+		e := newTestExporter(t, SetEndpoint(srv.URL+"/status"), SetInsecureSkipVerify(tt.insecure))
+		c := e.newCollector(e.defaultTargets())
+		// the client is reused, so scrape twice
+		for i := 0; i < 2; i++ {
+			if _, err := c.scrape(context.Background(), c.targets[0]); (err == nil) != tt.ok {
+				t.Errorf("insecure %v: scrape error %v", tt.insecure, err)
+			}
+		}
+	}
+}
+
+func TestValidateEndpoints(t *testing.T) {
+	tests := []struct {
+		name    string
+		option  OptionsFunc
+		wantErr bool
+	}{
+		{"http", SetEndpoint("http://127.0.0.1:9000/status"), false},
+		{"https", SetEndpoint("https://127.0.0.1:9000/status"), false},
+		{"tcp", SetFastcgi("tcp://127.0.0.1:9000/status"), false},
+		{"unix", SetFastcgi("unix:///run/php-fpm.sock"), false},
+		{"file endpoint", SetEndpoint("file:///var/run/php-fpm.status"), true},
+		{"unknown endpoint scheme", SetEndpoint("ftp://127.0.0.1/status"), true},
+		{"endpoint without scheme", SetEndpoint("127.0.0.1:9000/status"), true},
+		{"http fastcgi", SetFastcgi("http://127.0.0.1:9000/status"), true},
+		{"file fastcgi", SetFastcgi("file:///var/run/php-fpm.sock"), true},
+		{"unix without socket", SetFastcgi("unix://"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(SetLogger(zap.NewNop()), tt.option); (err != nil) != tt.wantErr {
+				t.Errorf("New error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSetFastcgiParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  []string
+		wantErr bool
+	}{
+		{"params", []string{"DOCUMENT_ROOT=/var/www", "HTTPS=on"}, false},
+		{"empty value", []string{"HTTPS="}, false},
+		{"equals sign in value", []string{"PHP_VALUE=a=b"}, false},
+		{"no equals sign", []string{"HTTPS"}, true},
+		{"no key", []string{"=on"}, true},
+		{"duplicate key", []string{"HTTPS=on", "HTTPS=off"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(SetLogger(zap.NewNop()), SetFastcgiParams(tt.params)); (err != nil) != tt.wantErr {
+				t.Errorf("New error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHTTPHostHeader(t *testing.T) {
+	hosts := make(chan string, 1)
+	serverNames := make(chan string, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts <- r.Host
+		w.Write([]byte(testStatus))
+	})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	tlsSrv := httptest.NewUnstartedServer(handler)
+	tlsSrv.TLS = &tls.Config{GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		serverNames <- hello.ServerName
+		// the certificate of httptest
+		return nil, nil
+	}}
+	tlsSrv.StartTLS()
+	defer tlsSrv.Close()
+
+	tests := []struct {
+		name       string
+		url        string
+		options    []OptionsFunc
+		host       string
+		serverName string
+	}{
+		{"no host", srv.URL, nil, srv.Listener.Addr().String(), ""},
+		{"host", srv.URL, []OptionsFunc{SetHTTPHostHeader("php.example.com")}, "php.example.com", ""},
+		{"host and port", srv.URL, []OptionsFunc{SetHTTPHostHeader("php.example.com:8080")}, "php.example.com:8080", ""},
+		{"host header", srv.URL, []OptionsFunc{SetHTTPHeaders([]string{"Host: php.example.com"})}, "php.example.com", ""},
+		{"tls without host", tlsSrv.URL, nil, tlsSrv.Listener.Addr().String(), ""},
+		{"tls host", tlsSrv.URL, []OptionsFunc{SetHTTPHostHeader("php.example.com")}, "php.example.com", "php.example.com"},
+		{"tls host and port", tlsSrv.URL, []OptionsFunc{SetHTTPHostHeader("php.example.com:8443")}, "php.example.com:8443", "php.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialed := make(chan string, 1)
+			dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+				dialed <- address
+				return (&net.Dialer{}).DialContext(ctx, network, address)
+			}
+			options := append([]OptionsFunc{SetEndpoint(tt.url + "/status"), SetInsecureSkipVerify(true), SetDialer(dial)}, tt.options...)
+			if _, err := scrapeOnce(newTestExporter(t, options...)); err != nil {
+				t.Fatal(err)
+			}
+			u, _ := url.Parse(tt.url)
+			if address := <-dialed; address != u.Host {
+				t.Errorf("dialed %s, want %s", address, u.Host)
+			}
+			if host := <-hosts; host != tt.host {
+				t.Errorf("Host %q sent, want %q", host, tt.host)
+			}
+			// the certificate is only asked for with a server name
+			var name string
+			select {
+			case name = <-serverNames:
+			default:
+			}
+			if name != tt.serverName {
+				t.Errorf("TLS server name %q sent, want %q", name, tt.serverName)
+			}
+		})
+	}
+}
@@ -0,0 +1,360 @@
+package exporter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// FastCGI record types and flags, see
+// https://fast-cgi.github.io/spec
+const (
+	fcgiVersion      = 1
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+
+	fcgiResponder = 1
+	fcgiKeepConn  = 1
+
+	fcgiMaxContent = 65535
+)
+
+// fcgiProtocolErrors are the reasons of a responder to reject a request, in
+// the protocolStatus of its END_REQUEST record.
+var fcgiProtocolErrors = map[byte]string{
+	1: "responder cannot multiplex connections",
+	2: "responder is overloaded",
+	3: "responder does not know the role",
+}
+
+// fcgiConn is a single connection to a FastCGI responder.
+type fcgiConn struct {
+	conn  net.Conn
+	reqID uint16
+}
+
+// fcgiResponse is the response to a FastCGI request.
+type fcgiResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	Timing     fcgiTiming
+}
+
+// fcgiTiming is the time taken by the parts of a FastCGI request: connect to
+// dial or take the idle connection, and read from sending the request until
+// the response was read.
+type fcgiTiming struct {
+	connect time.Duration
+	read    time.Duration
+}
+
+func (c *fcgiConn) writeRecord(recType uint8, content []byte) error {
+	if len(content) > fcgiMaxContent {
+		return errors.Errorf("fastcgi record of %d bytes is larger than %d bytes", len(content), fcgiMaxContent)
+	}
+	header := [8]byte{fcgiVersion, recType}
+	binary.BigEndian.PutUint16(header[2:], c.reqID)
+	binary.BigEndian.PutUint16(header[4:], uint16(len(content)))
+
+	if _, err := c.conn.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(content)
+	return err
+}
+
+func encodeSize(buf *bytes.Buffer, size int) {
+	if size < 128 {
+		buf.WriteByte(byte(size))
+		return
+	}
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(size)|1<<31)
+	buf.Write(b[:])
+}
+
+// writeParams writes params as a stream of PARAMS records, ended by an empty
+// one. The stream is split into records regardless of the pairs, which may span
+// several records.
+func (c *fcgiConn) writeParams(params map[string]string) error {
+	var buf bytes.Buffer
+	for k, v := range params {
+		encodeSize(&buf, len(k))
+		encodeSize(&buf, len(v))
+		buf.WriteString(k)
+		buf.WriteString(v)
+	}
+	for b := buf.Bytes(); len(b) > 0; {
+		n := len(b)
+		if n > fcgiMaxContent {
+			n = fcgiMaxContent
+		}
+		if err := c.writeRecord(fcgiParams, b[:n]); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return c.writeRecord(fcgiParams, nil)
+}
+
+// readStdout reads records until the end of the current request and returns
+// the data written to stdout. It fails if the responder rejected the request.
+func (c *fcgiConn) readStdout() ([]byte, error) {
+	var stdout bytes.Buffer
+	r := bufio.NewReader(c.conn)
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, err
+		}
+		length := binary.BigEndian.Uint16(header[4:])
+		padding := int(header[6])
+
+		content := make([]byte, int(length)+padding)
+		if _, err := io.ReadFull(r, content); err != nil {
+			return nil, err
+		}
+		content = content[:length]
+
+		if binary.BigEndian.Uint16(header[2:]) != c.reqID {
+			continue
+		}
+
+		switch header[1] {
+		case fcgiStdout:
+			stdout.Write(content)
+		case fcgiStderr:
+			// php-fpm writes errors to its own log as well, nothing to do
+		case fcgiEndRequest:
+			if len(content) >= 5 && content[4] != 0 {
+				msg, ok := fcgiProtocolErrors[content[4]]
+				if !ok {
+					msg = "unknown protocol status " + strconv.Itoa(int(content[4]))
+				}
+				return nil, errors.Errorf("fastcgi request rejected: %s", msg)
+			}
+			return stdout.Bytes(), nil
+		}
+	}
+}
+
+// watch interrupts any pending I/O on c once ctx is done. The returned
+// function must be called when the request is complete.
+func (c *fcgiConn) watch(ctx context.Context) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			c.conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// get issues a GET request with params and parses the CGI response.
+func (c *fcgiConn) get(ctx context.Context, params map[string]string, keepConn bool, readTimeout time.Duration) (*fcgiResponse, error) {
+	if readTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(readTimeout))
+	}
+	defer c.watch(ctx)()
+
+	c.reqID++
+	if c.reqID == 0 {
+		c.reqID = 1
+	}
+
+	var flags byte
+	if keepConn {
+		flags = fcgiKeepConn
+	}
+	begin := []byte{0, fcgiResponder, flags, 0, 0, 0, 0, 0}
+	if err := c.writeRecord(fcgiBeginRequest, begin); err != nil {
+		return nil, errors.Wrap(err, "failed to write begin request")
+	}
+
+	p := map[string]string{
+		"REQUEST_METHOD":  "GET",
+		"CONTENT_LENGTH":  "0",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+	}
+	for k, v := range params {
+		p[k] = v
+	}
+	if err := c.writeParams(p); err != nil {
+		return nil, errors.Wrap(err, "failed to write params")
+	}
+	if err := c.writeRecord(fcgiStdin, nil); err != nil {
+		return nil, errors.Wrap(err, "failed to write stdin")
+	}
+
+	stdout, err := c.readStdout()
+	if err != nil {
+		return nil, err
+	}
+	return parseCGIResponse(stdout)
+}
+
+// parseCGIResponse splits CGI output into headers and body. A missing Status
+// header leaves StatusCode at 0.
+func parseCGIResponse(stdout []byte) (*fcgiResponse, error) {
+	r := bufio.NewReader(bytes.NewReader(stdout))
+	header, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, errors.Wrap(err, "failed to read fastcgi headers")
+	}
+
+	resp := &fcgiResponse{Header: http.Header(header)}
+	if status := resp.Header.Get("Status"); status != "" {
+		code, err := strconv.Atoi(strings.Fields(status)[0])
+		if err != nil {
+			return nil, errors.Errorf("invalid fastcgi status %q", status)
+		}
+		resp.StatusCode = code
+	}
+
+	resp.Body, err = ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read fastcgi body")
+	}
+	return resp, nil
+}
+
+// fcgiClient issues requests to a single FastCGI responder. If keepAlive is
+// set, the connection is reused across requests and transparently re-dialed
+// when it was closed by the responder. timeout limits the dial and
+// readTimeout the time until the response is read. If proxyProtocol is set,
+// a PROXY protocol header of that version is sent on each new connection.
+// Connections are made with dialer, or a net.Dialer if it is nil.
+type fcgiClient struct {
+	network       string
+	address       string
+	timeout       time.Duration
+	readTimeout   time.Duration
+	keepAlive     bool
+	proxyProtocol int
+	dialer        dialFunc
+
+	mu   sync.Mutex
+	idle *fcgiConn
+}
+
+func (c *fcgiClient) dial(ctx context.Context) (*fcgiConn, error) {
+	conn, err := dialTimeout(ctx, c.dialer, c.network, c.address, c.timeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "fastcgi dial failed")
+	}
+	if c.proxyProtocol != 0 {
+		if c.timeout > 0 {
+			conn.SetWriteDeadline(time.Now().Add(c.timeout))
+		}
+		_, err := conn.Write(proxyHeader(c.proxyProtocol, conn))
+		conn.SetWriteDeadline(time.Time{})
+		if err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "failed to write proxy protocol header")
+		}
+	}
+	return &fcgiConn{conn: conn}, nil
+}
+
+// conn returns the idle connection, if any, or dials a new one.
+func (c *fcgiClient) conn(ctx context.Context) (*fcgiConn, bool, error) {
+	c.mu.Lock()
+	conn := c.idle
+	c.idle = nil
+	c.mu.Unlock()
+
+	if conn != nil {
+		return conn, true, nil
+	}
+	conn, err := c.dial(ctx)
+	return conn, false, err
+}
+
+// release keeps conn for the next request or closes it.
+func (c *fcgiClient) release(conn *fcgiConn) {
+	if !c.keepAlive {
+		conn.conn.Close()
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.idle != nil {
+		conn.conn.Close()
+		return
+	}
+	c.idle = conn
+}
+
+// close closes the idle connection, if any.
+func (c *fcgiClient) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.idle != nil {
+		c.idle.conn.Close()
+		c.idle = nil
+	}
+}
+
+// Get issues a GET request with params. The request is aborted once ctx is
+// done.
+func (c *fcgiClient) Get(ctx context.Context, params map[string]string) (*fcgiResponse, error) {
+	start := time.Now()
+	conn, reused, err := c.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	connect := time.Since(start)
+
+	start = time.Now()
+	resp, err := conn.get(ctx, params, c.keepAlive, c.readTimeout)
+	if err != nil && reused && ctx.Err() == nil {
+		// the responder may have closed the idle connection
+		conn.conn.Close()
+		start = time.Now()
+		if conn, err = c.dial(ctx); err != nil {
+			return nil, err
+		}
+		connect += time.Since(start)
+		start = time.Now()
+		resp, err = conn.get(ctx, params, c.keepAlive, c.readTimeout)
+	}
+	if err != nil {
+		conn.conn.Close()
+		return nil, errors.Wrap(err, "fastcgi get failed")
+	}
+
+	// clear the deadlines before the connection is reused
+	conn.conn.SetDeadline(time.Time{})
+	c.release(conn)
+	resp.Timing = fcgiTiming{connect: connect, read: time.Since(start)}
+	return resp, nil
+}
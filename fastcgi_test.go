@@ -0,0 +1,386 @@
+package exporter
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"strings"
+	"testing"
+	"time"
+)
+
+func BenchmarkScrapeFastcgi(b *testing.B) {
+	l := serveFastcgi(b, "tcp", "127.0.0.1:0", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testStatus))
+	})
+	defer l.Close()
+
+	tests := []struct {
+		name      string
+		keepAlive bool
+	}{
+		{"dial each scrape", false},
+		{"keep-alive", true},
+	}
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			e := newTestExporter(b, SetFastcgi("tcp://"+l.Addr().String()+"/status"), SetFastcgiKeepAlive(tt.keepAlive))
+			c := e.newCollector(e.defaultTargets())
+			t := c.targets[0]
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			defer t.fastcgiClient(e).close()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.scrape(context.Background(), t); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// fakeResponder answers fastcgi requests with fixed records. accepted receives
+// on each new connection, and ids and params the id and params stream of each
+// request.
+type fakeResponder struct {
+	net.Listener
+	accepted chan struct{}
+	ids      chan uint16
+	params   chan []byte
+}
+
+// fakeRecord is a record written by a fakeResponder. A zero reqID is replaced
+// by that of the request.
+type fakeRecord struct {
+	typ     uint8
+	reqID   uint16
+	content []byte
+	padding int
+}
+
+func stdoutRecord(s string, padding int) fakeRecord {
+	return fakeRecord{typ: fcgiStdout, content: []byte(s), padding: padding}
+}
+
+func endRecord(protocolStatus byte) fakeRecord {
+	return fakeRecord{typ: fcgiEndRequest, content: []byte{0, 0, 0, 0, protocolStatus, 0, 0, 0}}
+}
+
+// serveRecords answers every request with records on a new listener, closing
+// the connection after each request if closeConn is set.
+func serveRecords(t testing.TB, records []fakeRecord, closeConn bool) *fakeResponder {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeResponder{Listener: l, accepted: make(chan struct{}, 10), ids: make(chan uint16, 10), params: make(chan []byte, 10)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			f.accepted <- struct{}{}
+			go f.serve(conn, records, closeConn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeResponder) serve(conn net.Conn, records []fakeRecord, closeConn bool) {
+	defer conn.Close()
+	for {
+		id, params, err := readRequest(conn)
+		if err != nil {
+			return
+		}
+		f.ids <- id
+		f.params <- params
+		for _, rec := range records {
+			if rec.reqID == 0 {
+				rec.reqID = id
+			}
+			header := [8]byte{fcgiVersion, rec.typ}
+			binary.BigEndian.PutUint16(header[2:], rec.reqID)
+			binary.BigEndian.PutUint16(header[4:], uint16(len(rec.content)))
+			header[6] = byte(rec.padding)
+			b := append(append(header[:], rec.content...), make([]byte, rec.padding)...)
+			if _, err := conn.Write(b); err != nil {
+				return
+			}
+		}
+		if closeConn {
+			return
+		}
+	}
+}
+
+// readRequest reads the records of a request up to its empty stdin record and
+// returns its id and params stream.
+func readRequest(r io.Reader) (uint16, []byte, error) {
+	var params []byte
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return 0, nil, err
+		}
+		content := make([]byte, int(binary.BigEndian.Uint16(header[4:]))+int(header[6]))
+		if _, err := io.ReadFull(r, content); err != nil {
+			return 0, nil, err
+		}
+		switch header[1] {
+		case fcgiParams:
+			params = append(params, content...)
+		case fcgiStdin:
+			if len(content) == 0 {
+				return binary.BigEndian.Uint16(header[2:]), params, nil
+			}
+		}
+	}
+}
+
+// decodeParams decodes a params stream.
+func decodeParams(b []byte) (map[string]string, error) {
+	size := func() (int, error) {
+		if len(b) == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if b[0] < 128 {
+			n := int(b[0])
+			b = b[1:]
+			return n, nil
+		}
+		if len(b) < 4 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		n := int(binary.BigEndian.Uint32(b) &^ (1 << 31))
+		b = b[4:]
+		return n, nil
+	}
+	params := make(map[string]string)
+	for len(b) > 0 {
+		k, err := size()
+		if err != nil {
+			return nil, err
+		}
+		v, err := size()
+		if err != nil {
+			return nil, err
+		}
+		if len(b) < k+v {
+			return nil, io.ErrUnexpectedEOF
+		}
+		params[string(b[:k])] = string(b[k : k+v])
+		b = b[k+v:]
+	}
+	return params, nil
+}
+
+const fakeResponse = "Status: 200 OK\r\nContent-Type: text/plain\r\n\r\n" + testStatus
+
+func TestFastcgiParamsRecords(t *testing.T) {
+	f := serveRecords(t, []fakeRecord{stdoutRecord(fakeResponse, 0), endRecord(0)}, false)
+	defer f.Close()
+
+	tests := []struct {
+		name   string
+		params map[string]string
+	}{
+		{"small", map[string]string{"SCRIPT_FILENAME": "/status"}},
+		{"pair larger than a record", map[string]string{"SCRIPT_FILENAME": "/status", "PHP_VALUE": strings.Repeat("x", 3*fcgiMaxContent)}},
+		{"pairs larger than a record", map[string]string{"A": strings.Repeat("a", fcgiMaxContent-100), "B": strings.Repeat("b", fcgiMaxContent-100)}},
+		{"record filled exactly", map[string]string{"A": strings.Repeat("a", fcgiMaxContent-6)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &fcgiClient{network: "tcp", address: f.Addr().String(), timeout: time.Second, readTimeout: time.Second}
+			if _, err := c.Get(context.Background(), tt.params); err != nil {
+				t.Fatal(err)
+			}
+			got, err := decodeParams(<-f.params)
+			if err != nil {
+				t.Fatalf("invalid params stream: %v", err)
+			}
+			<-f.ids
+			for k, v := range tt.params {
+				if got[k] != v {
+					t.Errorf("param %s of %d bytes received as %d bytes", k, len(v), len(got[k]))
+				}
+			}
+		})
+	}
+}
+
+func TestFastcgiLargeParam(t *testing.T) {
+	values := make(chan string, 1)
+	l := serveFastcgi(t, "tcp", "127.0.0.1:0", func(w http.ResponseWriter, r *http.Request) {
+		values <- fcgi.ProcessEnv(r)["PHP_VALUE"]
+		w.Write([]byte(testStatus))
+	})
+	defer l.Close()
+
+	value := strings.Repeat("x", 100000)
+	c := &fcgiClient{network: "tcp", address: l.Addr().String(), timeout: time.Second, readTimeout: time.Second}
+	resp, err := c.Get(context.Background(), map[string]string{"SCRIPT_FILENAME": "/status", "PHP_VALUE": value})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Body) != testStatus {
+		t.Errorf("body %q, want %q", resp.Body, testStatus)
+	}
+	if got := <-values; got != value {
+		t.Errorf("param of %d bytes received as %d bytes", len(value), len(got))
+	}
+}
+
+func TestFastcgiRecordTooLarge(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	c := &fcgiConn{conn: client}
+	if err := c.writeRecord(fcgiStdin, make([]byte, fcgiMaxContent+1)); err == nil {
+		t.Error("record larger than the maximum written")
+	}
+}
+
+func TestFastcgiEndRequest(t *testing.T) {
+	tests := []struct {
+		name           string
+		protocolStatus byte
+		ok             bool
+	}{
+		{"request complete", 0, true},
+		{"cannot multiplex", 1, false},
+		{"overloaded", 2, false},
+		{"unknown role", 3, false},
+		{"unknown status", 9, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := serveRecords(t, []fakeRecord{endRecord(tt.protocolStatus)}, false)
+			defer f.Close()
+			c := &fcgiClient{network: "tcp", address: f.Addr().String(), timeout: time.Second, readTimeout: time.Second}
+			if _, err := c.Get(context.Background(), nil); (err == nil) != tt.ok {
+				t.Errorf("protocol status %d returned error %v, want success %v", tt.protocolStatus, err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestFastcgiRecords(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []fakeRecord
+	}{
+		{"single stdout", []fakeRecord{stdoutRecord(fakeResponse, 0), endRecord(0)}},
+		{"padded stdout", []fakeRecord{stdoutRecord(fakeResponse, 7), endRecord(0)}},
+		{"split stdout", []fakeRecord{stdoutRecord(fakeResponse[:20], 3), stdoutRecord(fakeResponse[20:], 5), endRecord(0)}},
+		{
+			"stderr",
+			[]fakeRecord{
+				{typ: fcgiStderr, content: []byte("PHP Warning: something"), padding: 2},
+				stdoutRecord(fakeResponse, 0),
+				{typ: fcgiStderr, content: []byte("PHP Notice: something else")},
+				endRecord(0),
+			},
+		},
+		{
+			"records of other requests",
+			[]fakeRecord{
+				{typ: fcgiStdout, reqID: 99, content: []byte("pool: other\n"), padding: 4},
+				stdoutRecord(fakeResponse, 0),
+				{typ: fcgiEndRequest, reqID: 99, content: []byte{0, 0, 0, 0, 2, 0, 0, 0}},
+				endRecord(0),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := serveRecords(t, tt.records, false)
+			defer f.Close()
+			c := &fcgiClient{network: "tcp", address: f.Addr().String(), timeout: time.Second, readTimeout: time.Second}
+			resp, err := c.Get(context.Background(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK || string(resp.Body) != testStatus {
+				t.Errorf("response %d %q, want 200 %q", resp.StatusCode, resp.Body, testStatus)
+			}
+		})
+	}
+}
+
+func TestFastcgiRedial(t *testing.T) {
+	tests := []struct {
+		name      string
+		keepAlive bool
+		closeConn bool
+		dials     int
+	}{
+		{"kept connection", true, false, 1},
+		{"connection closed by the responder", true, true, 3},
+		{"no keep-alive", false, false, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := serveRecords(t, []fakeRecord{stdoutRecord(fakeResponse, 0), endRecord(0)}, tt.closeConn)
+			defer f.Close()
+			c := &fcgiClient{network: "tcp", address: f.Addr().String(), timeout: time.Second, readTimeout: time.Second, keepAlive: tt.keepAlive}
+			defer c.close()
+			for i := 0; i < 3; i++ {
+				resp, err := c.Get(context.Background(), nil)
+				if err != nil {
+					t.Fatalf("request %d failed: %v", i+1, err)
+				}
+				if string(resp.Body) != testStatus {
+					t.Fatalf("request %d returned %q", i+1, resp.Body)
+				}
+				<-f.ids
+				if tt.closeConn {
+					// let the responder close the connection before it is
+					// reused
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+			if dials := len(f.accepted); dials != tt.dials {
+				t.Errorf("%d connections for 3 requests, want %d", dials, tt.dials)
+			}
+		})
+	}
+}
+
+func TestFastcgiRequestID(t *testing.T) {
+	tests := []struct {
+		last uint16
+		want uint16
+	}{
+		{0, 1},
+		{1, 2},
+		{65534, 65535},
+		{65535, 1},
+	}
+	f := serveRecords(t, []fakeRecord{stdoutRecord(fakeResponse, 0), endRecord(0)}, false)
+	defer f.Close()
+	for _, tt := range tests {
+		conn, err := net.Dial("tcp", f.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &fcgiConn{conn: conn, reqID: tt.last}
+		resp, err := c.get(context.Background(), nil, true, time.Second)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("request after id %d failed: %v", tt.last, err)
+		}
+		if string(resp.Body) != testStatus {
+			t.Errorf("request after id %d returned %q", tt.last, resp.Body)
+		}
+		if id := <-f.ids; id != tt.want || c.reqID != tt.want {
+			t.Errorf("request after id %d sent with id %d, kept %d, want %d", tt.last, id, c.reqID, tt.want)
+		}
+	}
+}
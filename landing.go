@@ -0,0 +1,48 @@
+package exporter
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/prometheus/common/version"
+	"go.uber.org/zap"
+)
+
+var landingTemplate = template.Must(template.New("landing").Parse(`<html>
+<head><title>PHP-FPM Exporter</title></head>
+<body>
+<h1>PHP-FPM Exporter</h1>
+<p>Version: {{.Version}} ({{.Revision}})</p>
+<p>Endpoints:</p>
+<ul>
+{{range .Endpoints}}<li>{{.}}</li>
+{{end}}</ul>
+<p><a href="{{.MetricsPath}}">Metrics</a></p>
+</body>
+</html>
+`))
+
+// landing serves a page linking to the metrics. Anything but the root path
+// is not found.
+func (e *Exporter) landing(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var endpoints []string
+	for _, t := range e.currentCollector().targets {
+		endpoints = append(endpoints, redact(t.url.String()))
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := landingTemplate.Execute(w, struct {
+		Version     string
+		Revision    string
+		Endpoints   []string
+		MetricsPath string
+	}{version.Version, version.Revision, endpoints, e.metricsPath})
+	if err != nil {
+		e.logger.Error("failed to render landing page", zap.Error(err))
+	}
+}
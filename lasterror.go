@@ -0,0 +1,116 @@
+package exporter
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	userinfoRegexp = regexp.MustCompile(`://([^:/@\s]+):[^@/\s]+@`)
+	secretRegexp   = regexp.MustCompile(`(?i)((?:password|passwd|token|secret)=)[^&\s"]+`)
+)
+
+// lastError holds the most recent scrape error. It is safe for concurrent use.
+type lastError struct {
+	mu        sync.Mutex
+	timestamp time.Time
+	message   string
+}
+
+type lastErrorResponse struct {
+	Timestamp *time.Time `json:"timestamp"`
+	Message   string     `json:"message"`
+	Pool      string     `json:"pool,omitempty"`
+}
+
+// redact removes credentials from an error message.
+func redact(msg string) string {
+	msg = userinfoRegexp.ReplaceAllString(msg, "://$1:xxxxx@")
+	return secretRegexp.ReplaceAllString(msg, "${1}xxxxx")
+}
+
+func (l *lastError) set(err error, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.timestamp = now
+	l.message = redact(err.Error())
+}
+
+func (l *lastError) get() (time.Time, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.timestamp, l.message
+}
+
+// errorCategories maps the messages scrape errors are wrapped with to the
+// category exported as the error label on the last error metric.
+var errorCategories = map[string]string{
+	"fastcgi dial failed":            "dial failed",
+	"fastcgi get failed":             "get failed",
+	"HTTP request failed":            "get failed",
+	"failed to read fastcgi headers": "read body",
+	"failed to read fastcgi body":    "read body",
+	"failed to read http body":       "read body",
+	"failed to read gzip http body":  "read body",
+	"failed to parse json status":    "parse failed",
+	"failed to parse xml status":     "parse failed",
+}
+
+// errorCategory returns a low-cardinality description of err, taken from the
+// innermost known message it was wrapped with.
+func errorCategory(err error) string {
+	type causer interface {
+		Cause() error
+	}
+
+	cause := errors.Cause(err)
+	if _, ok := cause.(*statusCodeError); ok {
+		return "unexpected status"
+	}
+	if uerr, ok := cause.(*url.Error); ok {
+		cause = uerr.Err
+	}
+	if oerr, ok := cause.(*net.OpError); ok && oerr.Op == "dial" {
+		return "dial failed"
+	}
+
+	category := "other"
+	for err != nil {
+		for msg, c := range errorCategories {
+			if strings.HasPrefix(err.Error(), msg+": ") {
+				category = c
+			}
+		}
+		cerr, ok := err.(causer)
+		if !ok {
+			break
+		}
+		err = cerr.Cause()
+	}
+	return category
+}
+
+// serveLastError serves the most recent error of any target as JSON.
+func (e *Exporter) serveLastError(w http.ResponseWriter, r *http.Request) {
+	var resp lastErrorResponse
+	for _, t := range e.currentCollector().targets {
+		ts, msg := t.lastError.get()
+		if ts.IsZero() || (resp.Timestamp != nil && !ts.After(*resp.Timestamp)) {
+			continue
+		}
+		resp.Timestamp = &ts
+		resp.Message = msg
+		resp.Pool = t.name
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
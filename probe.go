@@ -0,0 +1,254 @@
+package exporter
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+// target is a php-fpm status endpoint to scrape.
+type target struct {
+	// name is used as the pool label. It is empty when only a single
+	// endpoint is configured.
+	name string
+	// named is set when name was given explicitly rather than derived.
+	named   bool
+	url     *url.URL
+	fastcgi bool
+	// labels are added to the metrics of discovered targets.
+	labels map[string]string
+	// anonymous is set for targets of /probe that are not a configured
+	// endpoint, which are scraped without credentials.
+	anonymous bool
+	// statusPath replaces the status path of url, from the path parameter
+	// of /probe. For unix urls the path of url is still the socket.
+	statusPath string
+
+	// mu serializes scrapes and protects the state below.
+	mu sync.Mutex
+	// statusPool is the pool name from the most recent successful scrape,
+	// and poolKeys are the keys of the pool states it used.
+	statusPool   string
+	poolKeys     []string
+	failureCount int
+	parseErrors  int
+	cancelled    int
+	lastError    lastError
+	breaker      breaker
+	snapshot     snapshot
+	// httpStatus is the status code of the last HTTP scrape and httpErrors
+	// counts non-200 responses.
+	httpStatus  int
+	httpErrors  int
+	lastSuccess time.Time
+	// htmlBodies counts scrapes whose body looked like an HTML page.
+	htmlBodies int
+	// cached is the status of the last successful scrape, reused while it
+	// is younger than the cache duration.
+	cached *status
+	// warm is the last result of the warm-up, served to the first
+	// collection instead of scraping again.
+	warm *warmResult
+	// version is the php version from the version script, last updated
+	// at versionAt.
+	version   string
+	versionAt time.Time
+	// scrapes counts the scrapes of t to pace the detail scrapes, and detail
+	// is the status of the last successful one.
+	scrapes int
+	detail  *status
+
+	fcgi *fcgiClient
+	// fcgiTiming is the timing of the last fastcgi scrape of the status.
+	fcgiTiming fcgiTiming
+	// retired is set once a reload removed t, so that a scrape still in
+	// flight does not keep a connection open.
+	retired bool
+}
+
+// fastcgiClient returns the client used for fastcgi scrapes of t, replacing
+// it if the options of e changed. It must be called with t.mu held.
+func (t *target) fastcgiClient(e *Exporter) *fcgiClient {
+	keepAlive := e.fcgiKeepAlive && !t.retired
+	if t.fcgi != nil && t.fcgi.timeout == e.fcgiTimeout && t.fcgi.readTimeout == e.fcgiRead && t.fcgi.keepAlive == keepAlive && t.fcgi.proxyProtocol == e.fcgiProxy {
+		return t.fcgi
+	}
+	if t.fcgi != nil {
+		t.fcgi.close()
+	}
+
+	network, address, _ := fastcgiAddress(t.url)
+	t.fcgi = &fcgiClient{
+		network:       network,
+		address:       address,
+		timeout:       e.fcgiTimeout,
+		readTimeout:   e.fcgiRead,
+		keepAlive:     keepAlive,
+		proxyProtocol: e.fcgiProxy,
+		dialer:        e.dialer,
+	}
+	return t.fcgi
+}
+
+// dialAddress returns the network and address to connect to for t.
+func (t *target) dialAddress() (network string, address string) {
+	if t.fastcgi {
+		network, address, _ = fastcgiAddress(t.url)
+		return network, address
+	}
+
+	port := t.url.Port()
+	if port == "" {
+		port = "80"
+		if t.url.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return "tcp", net.JoinHostPort(t.url.Hostname(), port)
+}
+
+// label returns the pool label value of t. If fromStatus is set, the pool name
+// reported by php-fpm is preferred over a derived name.
+func (t *target) label(fromStatus bool) string {
+	if fromStatus && !t.named && t.statusPool != "" {
+		return t.statusPool
+	}
+	return t.name
+}
+
+// newTarget creates a target from u, using fastcgi for tcp and unix schemes
+// and HTTP otherwise.
+func newTarget(u *url.URL) (*target, error) {
+	var t *target
+	switch {
+	case httpSchemes[u.Scheme]:
+		t = &target{url: u}
+	case fastcgiSchemes[u.Scheme]:
+		t = &target{url: u, fastcgi: true}
+	default:
+		return nil, errors.Errorf("unsupported target scheme %q in %q", u.Scheme, u)
+	}
+	if err := validateAddress(u); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// validateAddress ensures u has a host, or a socket path for unix urls.
+func validateAddress(u *url.URL) error {
+	if u.Scheme == "unix" {
+		if u.Path == "" {
+			return errors.Errorf("missing socket path in %q: use unix:///path/to/socket", u)
+		}
+		return nil
+	}
+	if u.Hostname() == "" {
+		return errors.Errorf("missing host in %q", u)
+	}
+	return nil
+}
+
+// parseNamedTarget parses an endpoint given as either a url or name=url. If
+// no name is given, it is derived from the url.
+func parseNamedTarget(s string) (*target, error) {
+	var name string
+	if i := strings.Index(s, "="); i >= 0 {
+		if j := strings.Index(s, "://"); j < 0 || i < j {
+			name, s = s[:i], s[i+1:]
+		}
+	}
+	named := name != ""
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse url")
+	}
+	if name == "" {
+		name = u.Host + u.Path
+	}
+
+	t, err := newTarget(u)
+	if err != nil {
+		return nil, err
+	}
+	t.name = name
+	t.named = named
+	return t, nil
+}
+
+// defaultTargets returns the targets configured on the exporter. With file
+// service discovery or an endpoints file, only the endpoints given as a list
+// are added to the discovered ones.
+func (e *Exporter) defaultTargets() []*target {
+	if len(e.targets) > 0 || e.discovering() {
+		return e.targets
+	}
+	if e.fcgiEndpoint != nil {
+		return []*target{{url: e.fcgiEndpoint, fastcgi: true}}
+	}
+	return []*target{{url: e.endpoint}}
+}
+
+// configured reports whether u has the scheme and host of one of the targets
+// of c.
+func (c *collector) configured(u *url.URL) bool {
+	for _, t := range c.targets {
+		if t.url.Scheme == u.Scheme && strings.EqualFold(t.url.Host, u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// probe scrapes the target given in the request and serves only its metrics.
+func (e *Exporter) probe(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	rawurl := params.Get("target")
+	if rawurl == "" {
+		http.Error(w, "target parameter is missing", http.StatusBadRequest)
+		return
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		http.Error(w, "invalid target: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t, err := newTarget(u)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t.statusPath = params.Get("path")
+
+	current := e.currentCollector()
+	t.anonymous = !current.configured(u)
+
+	// the target is built for this request only, so a kept-alive fastcgi
+	// connection would never be reused
+	defer func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.fcgi != nil {
+			t.fcgi.close()
+		}
+	}()
+
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(contextCollector{current.exporter.newCollector([]*target{t}), r.Context()}); err != nil {
+		e.logger.Error("failed to register probe metrics", zap.Error(err))
+		http.Error(w, "failed to register metrics", http.StatusInternalServerError)
+		return
+	}
+
+	promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
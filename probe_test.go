@@ -0,0 +1,274 @@
+package exporter
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const testStatus = `pool:                 www
+process manager:      dynamic
+start time:           01/Jan/2024:12:00:00 +0000
+start since:          1234
+accepted conn:        42
+listen queue:         1
+max listen queue:     3
+listen queue len:     128
+idle processes:       2
+active processes:     3
+total processes:      5
+max active processes: 3
+max children reached: 0
+slow requests:        7
+`
+
+// newTestExporter creates an exporter that does not log.
+func newTestExporter(t testing.TB, options ...OptionsFunc) *Exporter {
+	e, err := New(append([]OptionsFunc{SetLogger(zap.NewNop())}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// serveFastcgi serves h as a fastcgi responder on a new listener.
+func serveFastcgi(t testing.TB, network, address string, h http.HandlerFunc) net.Listener {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go fcgi.Serve(l, h)
+	return l
+}
+
+// tempDir creates a directory removed by the returned function.
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "php-fpm-exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// probe requests /probe with query from e and returns the body.
+func probe(t *testing.T, e *Exporter, query string) string {
+	w := httptest.NewRecorder()
+	e.probe(w, httptest.NewRequest("GET", "/probe?"+query, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("probe returned %d: %s", w.Code, w.Body)
+	}
+	return w.Body.String()
+}
+
+func TestProbePath(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	socket := filepath.Join(dir, "fpm.sock")
+
+	scripts := make(chan string, 1)
+	l := serveFastcgi(t, "unix", socket, func(w http.ResponseWriter, r *http.Request) {
+		scripts <- fcgi.ProcessEnv(r)["SCRIPT_FILENAME"]
+		w.Write([]byte(testStatus))
+	})
+	defer l.Close()
+
+	body := probe(t, newTestExporter(t), "target=unix://"+socket+"&path=/fpm-status")
+	if !strings.Contains(body, "phpfpm_up 1") {
+		t.Fatalf("probe of unix socket failed:\n%s", body)
+	}
+	if script := <-scripts; script != "/fpm-status" {
+		t.Errorf("requested %q, want /fpm-status", script)
+	}
+}
+
+func TestProbeCredentials(t *testing.T) {
+	auths := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auths <- r.Header.Get("Authorization")
+		w.Write([]byte(testStatus))
+	}))
+	defer srv.Close()
+
+	basicAuth := SetBasicAuth("user", "secret")
+	bearerToken := SetBearerToken("secret", "")
+	header := SetHTTPHeaders([]string{"Authorization: Token secret"})
+	tests := []struct {
+		name     string
+		endpoint string
+		auth     OptionsFunc
+		sent     bool
+	}{
+		{"basic auth to configured endpoint", srv.URL + "/status", basicAuth, true},
+		{"basic auth to other host", "http://127.0.0.2:9000/status", basicAuth, false},
+		{"basic auth to other scheme", strings.Replace(srv.URL, "http:", "https:", 1) + "/status", basicAuth, false},
+		{"bearer token to configured endpoint", srv.URL + "/status", bearerToken, true},
+		{"bearer token to other host", "http://127.0.0.2:9000/status", bearerToken, false},
+		{"header to configured endpoint", srv.URL + "/status", header, true},
+		{"header to other host", "http://127.0.0.2:9000/status", header, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestExporter(t, SetEndpoint(tt.endpoint), tt.auth)
+			if body := probe(t, e, "target="+srv.URL+"/status"); !strings.Contains(body, "phpfpm_up 1") {
+				t.Fatalf("probe failed:\n%s", body)
+			}
+			if auth := <-auths; (auth != "") != tt.sent {
+				t.Errorf("Authorization %q sent, want credentials %v", auth, tt.sent)
+			}
+		})
+	}
+}
+
+// writeKeyPair writes a new self-signed certificate and its key to dir.
+func writeKeyPair(t *testing.T, dir string) (certFile string, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "php-fpm-exporter"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile = filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestProbeClientCertificate(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	certFile, keyFile := writeKeyPair(t, dir)
+
+	certs := make(chan int, 1)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		certs <- len(r.TLS.PeerCertificates)
+		w.Write([]byte(testStatus))
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		endpoint string
+		sent     bool
+	}{
+		{"configured endpoint", srv.URL + "/status", true},
+		{"other host", "https://127.0.0.2:9000/status", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestExporter(t,
+				SetEndpoint(tt.endpoint),
+				SetInsecureSkipVerify(true),
+				SetTLSClientFiles(certFile, keyFile, ""),
+			)
+			if body := probe(t, e, "target="+srv.URL+"/status"); !strings.Contains(body, "phpfpm_up 1") {
+				t.Fatalf("probe failed:\n%s", body)
+			}
+			if n := <-certs; (n > 0) != tt.sent {
+				t.Errorf("%d client certificates presented, want certificate %v", n, tt.sent)
+			}
+		})
+	}
+}
+
+// trackingListener counts the connections accepted and closed.
+type trackingListener struct {
+	net.Listener
+	accepted chan struct{}
+	closed   chan struct{}
+}
+
+type trackedConn struct {
+	net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.accepted <- struct{}{}
+	return &trackedConn{Conn: c, closed: l.closed}, nil
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		// the exporter closed its end
+		c.once.Do(func() { c.closed <- struct{}{} })
+	}
+	return n, err
+}
+
+func TestProbeClosesKeepAlive(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl := &trackingListener{Listener: l, accepted: make(chan struct{}, 10), closed: make(chan struct{}, 10)}
+	defer tl.Close()
+	go fcgi.Serve(tl, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testStatus))
+	}))
+
+	e := newTestExporter(t, SetFastcgiKeepAlive(true))
+	if body := probe(t, e, "target=tcp://"+l.Addr().String()+"/status"); !strings.Contains(body, "phpfpm_up 1") {
+		t.Fatalf("probe failed:\n%s", body)
+	}
+	<-tl.accepted
+	select {
+	case <-tl.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("kept-alive connection of the probe target was not closed")
+	}
+}
+
+func TestProbeRejectsScheme(t *testing.T) {
+	e := newTestExporter(t)
+	for _, target := range []string{"file:///etc/passwd", "ftp://127.0.0.1/status", "127.0.0.1:9000"} {
+		w := httptest.NewRecorder()
+		e.probe(w, httptest.NewRequest("GET", "/probe?target="+target, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("probe of %s returned %d, want %d", target, w.Code, http.StatusBadRequest)
+		}
+	}
+}
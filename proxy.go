@@ -0,0 +1,89 @@
+package exporter
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SetProxyURL creates a function that will send HTTP scrapes through the
+// proxy at rawurl instead of the one from the environment. Hosts listed in
+// NO_PROXY are still reached directly.
+// Generally only used when create a new Exporter.
+func SetProxyURL(rawurl string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		if rawurl == "" {
+			return nil
+		}
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return errors.Wrap(err, "failed to parse proxy url")
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return errors.Errorf("invalid proxy url %q", rawurl)
+		}
+		e.proxyURL = u
+		return nil
+	}
+}
+
+// proxyFunc returns the proxy selection of the HTTP transport.
+func (e *Exporter) proxyFunc() func(*http.Request) (*url.URL, error) {
+	if e.proxyURL == nil {
+		return http.ProxyFromEnvironment
+	}
+	noProxy := os.Getenv("NO_PROXY")
+	if noProxy == "" {
+		noProxy = os.Getenv("no_proxy")
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(req.URL, noProxy) {
+			return nil, nil
+		}
+		return e.proxyURL, nil
+	}
+}
+
+// bypassProxy reports whether u matches an entry of noProxy, a comma separated
+// list of hosts, domain suffixes, IPs or CIDR ranges given as in NO_PROXY.
+func bypassProxy(u *url.URL, noProxy string) bool {
+	host, port := u.Hostname(), u.Port()
+	ip := net.ParseIP(host)
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+		if _, ipnet, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && ipnet.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			if p != port {
+				continue
+			}
+			entry = h
+		}
+		if ip != nil {
+			if ip.Equal(net.ParseIP(entry)) {
+				return true
+			}
+			continue
+		}
+		host = strings.ToLower(host)
+		domain := strings.TrimPrefix(entry, ".")
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
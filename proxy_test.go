@@ -0,0 +1,82 @@
+package exporter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func TestBypassProxy(t *testing.T) {
+	tests := []struct {
+		rawurl  string
+		noProxy string
+		want    bool
+	}{
+		{"http://php-fpm:9000/status", "", false},
+		{"http://php-fpm:9000/status", "*", true},
+		{"http://php-fpm:9000/status", "other, php-fpm", true},
+		{"http://PHP-FPM:9000/status", "php-fpm", true},
+		{"http://www.example.com/status", ".example.com", true},
+		{"http://www.example.com/status", "example.com", true},
+		{"http://badexample.com/status", "example.com", false},
+		{"http://php-fpm:9000/status", "php-fpm:9000", true},
+		{"http://php-fpm:9001/status", "php-fpm:9000", false},
+		{"http://10.0.0.5/status", "10.0.0.0/8", true},
+		{"http://192.168.0.5/status", "10.0.0.0/8", false},
+		{"http://[::1]:9000/status", "::1", true},
+		{"http://10.0.0.5/status", "10.0.0.6", false},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.rawurl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := bypassProxy(u, tt.noProxy); got != tt.want {
+			t.Errorf("bypassProxy(%s, %q) = %v, want %v", tt.rawurl, tt.noProxy, got, tt.want)
+		}
+	}
+}
+
+func TestProxyURL(t *testing.T) {
+	const endpoint = "http://php-fpm.invalid:9000/status"
+	requested := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- r.URL.String()
+		w.Write([]byte(testStatus))
+	}))
+	defer proxy.Close()
+
+	defer os.Setenv("NO_PROXY", os.Getenv("NO_PROXY"))
+	tests := []struct {
+		name    string
+		noProxy string
+		proxied bool
+	}{
+		{"through the proxy", "", true},
+		{"host in NO_PROXY", "php-fpm.invalid", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("NO_PROXY", tt.noProxy)
+			e := newTestExporter(t, SetEndpoint(endpoint), SetProxyURL(proxy.URL))
+			_, err := scrapeOnce(e)
+			if (err == nil) != tt.proxied {
+				t.Fatalf("scrape returned error %v, want success %v", err, tt.proxied)
+			}
+			select {
+			case u := <-requested:
+				if !tt.proxied {
+					t.Errorf("%s requested through the proxy", u)
+				} else if u != endpoint {
+					t.Errorf("proxy asked for %s, want %s", u, endpoint)
+				}
+			default:
+				if tt.proxied {
+					t.Error("scrape did not go through the proxy")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package exporter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header, see
+// https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// SetFastcgiProxyProtocol creates a function that will send a PROXY protocol
+// header of version v1 or v2 on each new fastcgi connection, for php-fpm
+// behind a load balancer expecting one. An empty version disables it.
+// Generally only used when create a new Exporter.
+func SetFastcgiProxyProtocol(version string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		switch version {
+		case "":
+			e.fcgiProxy = 0
+		case "v1":
+			e.fcgiProxy = 1
+		case "v2":
+			e.fcgiProxy = 2
+		default:
+			return errors.Errorf("unsupported proxy protocol version %q: use v1 or v2", version)
+		}
+		return nil
+	}
+}
+
+// proxyHeader returns the PROXY protocol header of version for conn, using
+// its local address as the source. Connections other than TCP, e.g. unix
+// sockets, are sent as UNKNOWN in v1 and as UNSPEC in v2.
+func proxyHeader(version int, conn net.Conn) []byte {
+	src, _ := conn.LocalAddr().(*net.TCPAddr)
+	dst, _ := conn.RemoteAddr().(*net.TCPAddr)
+	if src == nil || dst == nil {
+		if version == 1 {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		return append(append([]byte{}, proxyV2Signature...), 0x21, 0x00, 0, 0)
+	}
+
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	v6 := srcIP == nil || dstIP == nil
+	if v6 {
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	}
+
+	if version == 1 {
+		family := "TCP4"
+		if v6 {
+			family = "TCP6"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcIP, dstIP, src.Port, dst.Port))
+	}
+
+	var buf bytes.Buffer
+	buf.Write(proxyV2Signature)
+	// version 2, PROXY command
+	buf.WriteByte(0x21)
+	if v6 {
+		buf.WriteByte(0x21)
+	} else {
+		buf.WriteByte(0x11)
+	}
+	binary.Write(&buf, binary.BigEndian, uint16(2*len(srcIP)+4))
+	buf.Write(srcIP)
+	buf.Write(dstIP)
+	binary.Write(&buf, binary.BigEndian, uint16(src.Port))
+	binary.Write(&buf, binary.BigEndian, uint16(dst.Port))
+	return buf.Bytes()
+}
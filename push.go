@@ -0,0 +1,110 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"go.uber.org/zap"
+)
+
+// SetPushGateway creates a function that will enable pushing metrics to a
+// Prometheus Pushgateway at rawurl every interval, grouped by job and instance.
+// Generally only used when create a new Exporter.
+func SetPushGateway(rawurl string, job string, instance string, interval time.Duration) func(*Exporter) error {
+	return func(e *Exporter) error {
+		if rawurl == "" {
+			return nil
+		}
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return errors.Wrap(err, "failed to parse pushgateway url")
+		}
+		if job == "" {
+			return errors.New("pushgateway job must not be empty")
+		}
+		if interval <= 0 {
+			return errors.New("push interval must be positive")
+		}
+		e.pushURL = u
+		e.pushJob = job
+		e.pushInstance = instance
+		e.pushInterval = interval
+		return nil
+	}
+}
+
+// pushPath builds the grouping key path for the pushgateway.
+func (e *Exporter) pushPath() string {
+	u := *e.pushURL
+	// the escaped path is kept along, so a job or instance containing a
+	// slash stays a single segment
+	path := strings.TrimSuffix(u.Path, "/") + "/metrics/job/" + e.pushJob
+	rawPath := strings.TrimSuffix(u.EscapedPath(), "/") + "/metrics/job/" + url.PathEscape(e.pushJob)
+	if e.pushInstance != "" {
+		path += "/instance/" + e.pushInstance
+		rawPath += "/instance/" + url.PathEscape(e.pushInstance)
+	}
+	u.Path = path
+	u.RawPath = rawPath
+	return u.String()
+}
+
+// push gathers all registered metrics and replaces the group on the pushgateway.
+// The push package of the vendored client_golang is not used, as it fails on
+// any status but 202 while Pushgateway 0.10 and later answer 200.
+func (e *Exporter) push(g prometheus.Gatherer) error {
+	mfs, err := g.Gather()
+	if err != nil {
+		return errors.Wrap(err, "failed to gather metrics")
+	}
+
+	var buf bytes.Buffer
+	enc := expfmt.NewEncoder(&buf, expfmt.FmtText)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			return errors.Wrap(err, "failed to encode metrics")
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPut, e.pushPath(), &buf)
+	if err != nil {
+		return errors.Wrap(err, "failed to create push request")
+	}
+	req.Header.Set("Content-Type", string(expfmt.FmtText))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "push request failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return errors.Errorf("unexpected pushgateway status: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// runPush pushes metrics every pushInterval until ctx is done.
+func (e *Exporter) runPush(ctx context.Context, g prometheus.Gatherer) error {
+	ticker := time.NewTicker(e.pushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := e.push(g); err != nil {
+				e.logger.Error("failed to push metrics", zap.Error(err))
+			}
+		}
+	}
+}
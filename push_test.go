@@ -0,0 +1,86 @@
+package exporter
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPush(t *testing.T) {
+	tests := []struct {
+		name     string
+		job      string
+		instance string
+		status   int
+		path     string
+		wantErr  bool
+	}{
+		{"job", "phpfpm", "", http.StatusOK, "/metrics/job/phpfpm", false},
+		{"job and instance", "phpfpm", "web-1", http.StatusOK, "/metrics/job/phpfpm/instance/web-1", false},
+		{"escaped instance", "phpfpm", "web/1", http.StatusOK, "/metrics/job/phpfpm/instance/web%2F1", false},
+		{"accepted", "phpfpm", "", http.StatusAccepted, "/metrics/job/phpfpm", false},
+		{"server error", "phpfpm", "", http.StatusInternalServerError, "/metrics/job/phpfpm", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var method, path, contentType, body string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := ioutil.ReadAll(r.Body)
+				method, path, contentType, body = r.Method, r.URL.EscapedPath(), r.Header.Get("Content-Type"), string(b)
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+
+			e := newTestExporter(t, SetPushGateway(srv.URL+"/", tt.job, tt.instance, time.Minute))
+			reg := prometheus.NewRegistry()
+			g := prometheus.NewGauge(prometheus.GaugeOpts{Name: "pushed", Help: "A pushed gauge"})
+			g.Set(3)
+			reg.MustRegister(g)
+
+			if err := e.push(reg); (err != nil) != tt.wantErr {
+				t.Fatalf("push error %v, want error %v", err, tt.wantErr)
+			}
+			if method != http.MethodPut {
+				t.Errorf("pushed with %s, want PUT", method)
+			}
+			if path != tt.path {
+				t.Errorf("pushed to %s, want %s", path, tt.path)
+			}
+			if !strings.HasPrefix(contentType, "text/plain") {
+				t.Errorf("pushed as %q, want the text format", contentType)
+			}
+			if !strings.Contains(body, "pushed 3") {
+				t.Errorf("pushed body lacks the gauge:\n%s", body)
+			}
+		})
+	}
+}
+
+func TestSetPushGateway(t *testing.T) {
+	tests := []struct {
+		name     string
+		url      string
+		job      string
+		interval time.Duration
+		wantErr  bool
+	}{
+		{"disabled", "", "", 0, false},
+		{"valid", "http://127.0.0.1:9091", "phpfpm", time.Minute, false},
+		{"empty job", "http://127.0.0.1:9091", "", time.Minute, true},
+		{"zero interval", "http://127.0.0.1:9091", "phpfpm", 0, true},
+		{"invalid url", "http://[::1", "phpfpm", time.Minute, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var e Exporter
+			if err := SetPushGateway(tt.url, tt.job, "", tt.interval)(&e); (err != nil) != tt.wantErr {
+				t.Errorf("error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
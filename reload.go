@@ -0,0 +1,122 @@
+package exporter
+
+import (
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// currentCollector returns the collector serving the current configuration.
+// Before Run it is created from the exporter's own options.
+func (e *Exporter) currentCollector() *collector {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.current == nil {
+		return e.newCollector(e.defaultTargets())
+	}
+	return e.current
+}
+
+// Reload replaces the scrape configuration of a running exporter with the one
+// built from options. Targets with the same name and url as before keep their
+// counters, the others close their kept-alive fastcgi connection. Scrapes in
+// flight complete with the previous configuration. The listen address, TLS and
+// push options are not changed, nor whether and how often discovery files are
+// re-read, but the files read are the new ones. On error the previous
+// configuration stays in use.
+func (e *Exporter) Reload(options ...OptionsFunc) error {
+	n, err := New(append([]OptionsFunc{SetLogger(e.logger)}, options...)...)
+	if err != nil {
+		return errors.Wrap(err, "failed to create exporter")
+	}
+
+	var discovered []*target
+	if n.discovering() {
+		if discovered, err = n.discoverTargets(n.defaultTargets()); err != nil {
+			return errors.Wrap(err, "failed to discover targets")
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.replaceCollector(n, discovered); err != nil {
+		return err
+	}
+	e.discovered = discovered
+	return nil
+}
+
+// replaceCollector swaps in a collector of n scraping its targets and
+// discovered. It must be called with e.mu held.
+func (e *Exporter) replaceCollector(n *Exporter, discovered []*target) error {
+	old := e.current
+	if old == nil {
+		return errors.New("exporter is not running")
+	}
+
+	targets := mergeTargets(old.targets, append(append([]*target{}, n.defaultTargets()...), discovered...))
+	c := n.newCollector(targets)
+	if err := prometheus.NewRegistry().Register(c); err != nil {
+		return errors.Wrap(err, "failed to register metrics")
+	}
+
+	old.mu.Lock()
+	for key, state := range old.pools {
+		c.pools[key] = state
+	}
+	old.mu.Unlock()
+
+	e.current = c
+	go retireTargets(old.targets, targets)
+	return nil
+}
+
+// retireTargets closes the kept-alive fastcgi connections of the targets of old
+// missing from targets. It waits for scrapes of them still in flight.
+func retireTargets(old []*target, targets []*target) {
+	kept := make(map[*target]bool, len(targets))
+	for _, t := range targets {
+		kept[t] = true
+	}
+	for _, t := range old {
+		if kept[t] {
+			continue
+		}
+		t.mu.Lock()
+		t.retired = true
+		if t.fcgi != nil {
+			t.fcgi.close()
+			t.fcgi = nil
+		}
+		t.mu.Unlock()
+	}
+}
+
+// mergeTargets returns targets with each entry replaced by the target of old
+// with the same name, url and labels, if any.
+func mergeTargets(old []*target, targets []*target) []*target {
+	merged := make([]*target, 0, len(targets))
+	for _, t := range targets {
+		for _, o := range old {
+			if sameTarget(o, t) {
+				t = o
+				break
+			}
+		}
+		merged = append(merged, t)
+	}
+	return merged
+}
+
+// sameTarget reports whether a and b scrape the same endpoint with the same
+// labels.
+func sameTarget(a *target, b *target) bool {
+	if a.name != b.name || a.url.String() != b.url.String() || len(a.labels) != len(b.labels) {
+		return false
+	}
+	for k, v := range a.labels {
+		if b.labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
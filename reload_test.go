@@ -0,0 +1,63 @@
+package exporter
+
+import (
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReloadClosesKeepAlive(t *testing.T) {
+	tests := []struct {
+		name   string
+		other  bool
+		closed bool
+	}{
+		{"endpoint removed", true, true},
+		{"endpoint kept", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			tl := &trackingListener{Listener: l, accepted: make(chan struct{}, 10), closed: make(chan struct{}, 10)}
+			defer tl.Close()
+			go fcgi.Serve(tl, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(testStatus))
+			}))
+
+			endpoint := "tcp://" + l.Addr().String() + "/status"
+			e := newTestExporter(t, SetFastcgi(endpoint), SetFastcgiKeepAlive(true))
+			e.current = e.newCollector(e.defaultTargets())
+			if up, _ := metricValue(gatherCollector(t, e), "phpfpm_up"); up != 1 {
+				t.Fatal("scrape failed")
+			}
+			<-tl.accepted
+
+			if tt.other {
+				endpoint = strings.Replace(endpoint, "/status", "/other-status", 1)
+			}
+			if err := e.Reload(SetFastcgi(endpoint), SetFastcgiKeepAlive(true)); err != nil {
+				t.Fatal(err)
+			}
+			wait := 5 * time.Second
+			if !tt.closed {
+				wait = 200 * time.Millisecond
+			}
+			select {
+			case <-tl.closed:
+				if !tt.closed {
+					t.Error("kept-alive connection of a kept endpoint was closed")
+				}
+			case <-time.After(wait):
+				if tt.closed {
+					t.Error("kept-alive connection of a removed endpoint was not closed")
+				}
+			}
+		})
+	}
+}
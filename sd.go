@@ -0,0 +1,230 @@
+package exporter
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// SetFileSD creates a function that will scrape the targets listed in the
+// json and yaml files in dir in addition to the configured endpoints. The
+// files use the Prometheus file_sd format and are re-read every interval.
+// Generally only used when create a new Exporter.
+func SetFileSD(dir string, interval time.Duration) func(*Exporter) error {
+	return func(e *Exporter) error {
+		if dir == "" {
+			return nil
+		}
+		if interval <= 0 {
+			return errors.New("file sd interval must be positive")
+		}
+		e.sdDir = dir
+		e.sdInterval = interval
+		return nil
+	}
+}
+
+// SetEndpointsFile creates a function that will scrape the endpoints listed
+// in the text file at path in addition to the configured endpoints. The file
+// holds endpoints separated by commas or newlines, each as url or name=url,
+// with comments starting at #, and is re-read every interval.
+// Generally only used when create a new Exporter.
+func SetEndpointsFile(path string, interval time.Duration) func(*Exporter) error {
+	return func(e *Exporter) error {
+		if path == "" {
+			return nil
+		}
+		if interval <= 0 {
+			return errors.New("endpoints file interval must be positive")
+		}
+		e.endpointsFile = path
+		e.sdInterval = interval
+		return nil
+	}
+}
+
+// discovering reports whether targets are discovered from files.
+func (e *Exporter) discovering() bool {
+	return e.sdDir != "" || e.endpointsFile != ""
+}
+
+// sdGroup is a group of targets sharing labels in a file_sd file.
+type sdGroup struct {
+	Targets []string          `yaml:"targets"`
+	Labels  map[string]string `yaml:"labels"`
+}
+
+// sdPatterns match the discovery files in the file_sd directory, as read by
+// Prometheus.
+var sdPatterns = []string{"*.json", "*.yml", "*.yaml"}
+
+// reservedLabels are used by the metrics themselves and cannot be set from
+// discovery files.
+var reservedLabels = map[string]bool{
+	"pool": true, "state": true, "pid": true, "mode": true, "reason": true,
+	"version": true, "revision": true, "goversion": true, "error": true, "le": true,
+}
+
+// discoverTargets reads all discovery files and the endpoints file. Invalid
+// targets and labels are skipped, but a file that cannot be read fails the
+// whole discovery so that a partially written file does not drop its targets.
+func (e *Exporter) discoverTargets(static []*target) ([]*target, error) {
+	var files []string
+	if e.sdDir != "" {
+		for _, pattern := range sdPatterns {
+			matches, err := filepath.Glob(filepath.Join(e.sdDir, pattern))
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to list discovery files")
+			}
+			files = append(files, matches...)
+		}
+		sort.Strings(files)
+	}
+
+	names := make(map[string]bool)
+	for _, t := range static {
+		names[t.name] = true
+	}
+
+	var targets []*target
+	if e.endpointsFile != "" {
+		listed, err := e.readEndpointsFile(names)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, listed...)
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read discovery file")
+		}
+		// json files are read as yaml, of which json is a subset
+		var groups []sdGroup
+		if err := yaml.Unmarshal(data, &groups); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse discovery file %s", file)
+		}
+
+		for _, g := range groups {
+			labels := make(map[string]string)
+			for name, value := range g.Labels {
+				if !labelNameRegexp.MatchString(name) || strings.HasPrefix(name, "__") || reservedLabels[name] || e.constLabels[name] != "" {
+					e.logger.Warn("ignoring discovered label", zap.String("file", file), zap.String("label", name))
+					continue
+				}
+				labels[name] = value
+			}
+
+			for _, raw := range g.Targets {
+				t, err := parseNamedTarget(raw)
+				if err != nil {
+					e.logger.Warn("ignoring discovered target", zap.String("file", file), zap.String("target", redact(raw)), zap.Error(err))
+					continue
+				}
+				if names[t.name] {
+					e.logger.Warn("ignoring duplicate discovered target", zap.String("file", file), zap.String("name", t.name))
+					continue
+				}
+				names[t.name] = true
+				t.labels = labels
+				targets = append(targets, t)
+			}
+		}
+	}
+	return targets, nil
+}
+
+// readEndpointsFile parses the endpoints file, skipping malformed endpoints and
+// those whose name is already in names.
+func (e *Exporter) readEndpointsFile(names map[string]bool) ([]*target, error) {
+	data, err := ioutil.ReadFile(e.endpointsFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read endpoints file")
+	}
+
+	var targets []*target
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		for _, raw := range strings.Split(line, ",") {
+			if raw = strings.TrimSpace(raw); raw == "" {
+				continue
+			}
+			t, err := parseNamedTarget(raw)
+			if err != nil {
+				e.logger.Warn("ignoring listed endpoint", zap.String("file", e.endpointsFile), zap.String("target", redact(raw)), zap.Error(err))
+				continue
+			}
+			if names[t.name] {
+				e.logger.Warn("ignoring duplicate listed endpoint", zap.String("file", e.endpointsFile), zap.String("name", t.name))
+				continue
+			}
+			names[t.name] = true
+			targets = append(targets, t)
+		}
+	}
+	return targets, nil
+}
+
+// refreshTargets replaces the discovered targets if the discovery files
+// changed. Targets no longer listed stop being scraped. The files are those of
+// the current configuration, which a reload may have changed.
+func (e *Exporter) refreshTargets() {
+	current := e.currentCollector().exporter
+	discovered, err := current.discoverTargets(current.defaultTargets())
+	if err != nil {
+		e.logger.Error("failed to discover targets, keeping the previous ones", zap.Error(err))
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if sameTargets(e.discovered, discovered) {
+		return
+	}
+	if err := e.replaceCollector(e.current.exporter, discovered); err != nil {
+		e.logger.Error("failed to apply discovered targets", zap.Error(err))
+		return
+	}
+	e.discovered = discovered
+	e.logger.Info("discovered targets changed", zap.Int("targets", len(discovered)))
+}
+
+// sameTargets reports whether a and b contain the same targets in order.
+func sameTargets(a []*target, b []*target) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !sameTarget(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// runFileSD refreshes the discovered targets, including those of the endpoints
+// file, every sdInterval until ctx is done. The files are polled rather than
+// watched: fsnotify is not vendored, and watches miss the symlink swaps of
+// Kubernetes ConfigMap volumes and changes on network filesystems.
+func (e *Exporter) runFileSD(ctx context.Context) error {
+	ticker := time.NewTicker(e.sdInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			e.refreshTargets()
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package exporter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeFile writes content to the file name in dir.
+func writeFile(t *testing.T, dir string, name string, content string) {
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// targetNames returns the names of targets.
+func targetNames(targets []*target) []string {
+	var names []string
+	for _, t := range targets {
+		names = append(names, t.name)
+	}
+	return names
+}
+
+// startDiscovery sets the collector of a running e and discovers its targets
+// once, as Run does.
+func startDiscovery(e *Exporter) {
+	e.mu.Lock()
+	e.current = e.newCollector(e.defaultTargets())
+	e.mu.Unlock()
+	e.refreshTargets()
+}
+
+func TestDiscoverTargetsFormats(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    []string
+	}{
+		{"json", "targets.json", `[{"targets": ["www=tcp://10.0.0.1:9000/status"], "labels": {"env": "prod"}}]`, []string{"www"}},
+		{"json with tabs", "targets.json", "[\n\t{\n\t\t\"targets\": [\"www=tcp://10.0.0.1:9000/status\"]\n\t}\n]\n", []string{"www"}},
+		{"yml", "targets.yml", "- targets:\n    - www=tcp://10.0.0.1:9000/status\n  labels:\n    env: prod\n", []string{"www"}},
+		{"yaml", "targets.yaml", "- targets: [www=tcp://10.0.0.1:9000/status, api=tcp://10.0.0.2:9000/status]\n", []string{"www", "api"}},
+		{"other extension", "targets.txt", `[{"targets": ["www=tcp://10.0.0.1:9000/status"]}]`, nil},
+		{"empty yaml", "targets.yml", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, cleanup := tempDir(t)
+			defer cleanup()
+			writeFile(t, dir, tt.file, tt.content)
+
+			e := newTestExporter(t, SetFileSD(dir, time.Minute))
+			targets, err := e.discoverTargets(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := targetNames(targets); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("discovered %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiscoverTargetsInvalid(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	writeFile(t, dir, "targets.yml", "- targets: [www=tcp://10.0.0.1:9000/status\n")
+
+	e := newTestExporter(t, SetFileSD(dir, time.Minute))
+	if _, err := e.discoverTargets(nil); err == nil {
+		t.Error("discovery of an invalid file succeeded")
+	}
+}
+
+func TestRefreshTargetsRemoval(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	writeFile(t, dir, "a.json", `[{"targets": ["www=tcp://10.0.0.1:9000/status"]}]`)
+	writeFile(t, dir, "b.yml", "- targets: [api=tcp://10.0.0.2:9000/status]\n")
+
+	e := newTestExporter(t, SetFileSD(dir, time.Minute))
+	startDiscovery(e)
+	if got := targetNames(e.currentCollector().targets); !reflect.DeepEqual(got, []string{"www", "api"}) {
+		t.Fatalf("scraping %q, want www and api", got)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "b.yml")); err != nil {
+		t.Fatal(err)
+	}
+	e.refreshTargets()
+	if got := targetNames(e.currentCollector().targets); !reflect.DeepEqual(got, []string{"www"}) {
+		t.Errorf("scraping %q after removing a file, want www", got)
+	}
+
+	writeFile(t, dir, "a.json", `[]`)
+	e.refreshTargets()
+	if got := targetNames(e.currentCollector().targets); len(got) != 0 {
+		t.Errorf("scraping %q after removing every target, want none", got)
+	}
+}
+
+func TestReloadFileSDDir(t *testing.T) {
+	before, cleanupBefore := tempDir(t)
+	defer cleanupBefore()
+	after, cleanupAfter := tempDir(t)
+	defer cleanupAfter()
+	writeFile(t, before, "targets.json", `[{"targets": ["www=tcp://10.0.0.1:9000/status"]}]`)
+	writeFile(t, after, "targets.yml", "- targets: [api=tcp://10.0.0.2:9000/status]\n")
+
+	e := newTestExporter(t, SetFileSD(before, time.Minute))
+	startDiscovery(e)
+
+	if err := e.Reload(SetFileSD(after, time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if got := targetNames(e.currentCollector().targets); !reflect.DeepEqual(got, []string{"api"}) {
+		t.Fatalf("scraping %q after reload, want api from the new directory", got)
+	}
+
+	// the periodic refresh must read the new directory too
+	e.refreshTargets()
+	if got := targetNames(e.currentCollector().targets); !reflect.DeepEqual(got, []string{"api"}) {
+		t.Errorf("scraping %q after refresh, want api from the new directory", got)
+	}
+}
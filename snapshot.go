@@ -0,0 +1,85 @@
+package exporter
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// snapshot is the result of the most recent scrape of a target. It is safe
+// for concurrent use, so it can be served while the target is scraped.
+type snapshot struct {
+	mu        sync.Mutex
+	timestamp time.Time
+	// status is nil if the scrape failed.
+	status *status
+}
+
+func (s *snapshot) set(st *status, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timestamp = now
+	s.status = st
+}
+
+func (s *snapshot) get() (time.Time, *status) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.timestamp, s.status
+}
+
+type lastErrorSnapshot struct {
+	Timestamp time.Time `json:"timestamp"`
+	Message   string    `json:"message"`
+}
+
+type targetSnapshot struct {
+	Pool       string                 `json:"pool,omitempty"`
+	Endpoint   string                 `json:"endpoint"`
+	Up         bool                   `json:"up"`
+	LastScrape *time.Time             `json:"last_scrape"`
+	LastError  *lastErrorSnapshot     `json:"last_error,omitempty"`
+	Fields     map[string]interface{} `json:"fields,omitempty"`
+	Processes  []processStatus        `json:"processes,omitempty"`
+}
+
+type statusSnapshot struct {
+	Targets []targetSnapshot `json:"targets"`
+}
+
+// serveStatusJSON serves the status parsed by the most recent scrape of each
+// target as JSON, without scraping php-fpm.
+func (e *Exporter) serveStatusJSON(w http.ResponseWriter, r *http.Request) {
+	resp := statusSnapshot{Targets: []targetSnapshot{}}
+	for _, t := range e.currentCollector().targets {
+		ts, st := t.snapshot.get()
+		s := targetSnapshot{
+			Pool:     t.name,
+			Endpoint: redact(t.url.String()),
+			Up:       st != nil,
+		}
+		if !ts.IsZero() {
+			s.LastScrape = &ts
+		}
+		if ets, msg := t.lastError.get(); !ets.IsZero() {
+			s.LastError = &lastErrorSnapshot{Timestamp: ets, Message: msg}
+		}
+		if st != nil {
+			s.Fields = make(map[string]interface{}, len(st.fields))
+			for _, f := range st.fields {
+				if v, err := strconv.ParseFloat(f.value, 64); err == nil {
+					s.Fields[f.key] = v
+					continue
+				}
+				s.Fields[f.key] = f.value
+			}
+			s.Processes = st.processes
+		}
+		resp.Targets = append(resp.Targets, s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,169 @@
+package exporter
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// SetFailFast creates a function that will make Run return an error if any
+// endpoint cannot be scraped at startup, instead of serving phpfpm_up 0 until
+// php-fpm is up.
+// Generally only used when create a new Exporter.
+func SetFailFast(enabled bool) func(*Exporter) error {
+	return func(e *Exporter) error {
+		e.failFast = enabled
+		return nil
+	}
+}
+
+// SetWarmup creates a function that will scrape all endpoints concurrently in
+// the background at startup, retrying each until it succeeded or timeout
+// passed, and hold back /metrics requests until then. The first collection
+// serves the warm-up results. This avoids reporting phpfpm_up 0 for a php-fpm
+// still starting. A zero timeout disables the warm-up.
+// Generally only used when create a new Exporter.
+func SetWarmup(timeout time.Duration) func(*Exporter) error {
+	return func(e *Exporter) error {
+		if timeout < 0 {
+			return errors.New("warm-up timeout must not be negative")
+		}
+		e.warmupTimeout = timeout
+		return nil
+	}
+}
+
+// warmupInterval is the wait between warm-up scrapes of a failing target.
+const warmupInterval = time.Second
+
+// checkTargets scrapes each target of c once, with the configured retries,
+// and returns the first error.
+func (c *collector) checkTargets(ctx context.Context) error {
+	for _, t := range c.targets {
+		t.mu.Lock()
+		_, _, err := c.scrapeWithRetry(ctx, t)
+		t.mu.Unlock()
+		if err != nil {
+			return errors.Wrapf(err, "failed to scrape %s", redact(t.url.String()))
+		}
+	}
+	return nil
+}
+
+// checkStartup checks that the targets can be scraped. With fail fast, an
+// unreachable target is an error. Otherwise the check happens in the
+// background and only logs a warning, since php-fpm is often started at the
+// same time as the exporter. The warm-up, if enabled, replaces the background
+// check.
+func (e *Exporter) checkStartup() error {
+	c := e.currentCollector()
+	if e.failFast {
+		return c.checkTargets(context.Background())
+	}
+	if e.warmupTimeout > 0 {
+		return nil
+	}
+
+	go func() {
+		if err := c.checkTargets(context.Background()); err != nil {
+			e.logger.Warn("php-fpm is not reachable yet, exporting phpfpm_up 0 until it is", zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+// warmResult is the result of the last warm-up scrape of a target.
+type warmResult struct {
+	body     []byte
+	attempts int
+	err      error
+	duration time.Duration
+	// expires is the end of the warm-up of the target plus the warm-up
+	// timeout, unset while the warm-up is still going on.
+	expires time.Time
+}
+
+// takeWarmup returns the warm-up result of t and clears it, or nil if there is
+// none or it expired. It must be called with t.mu held.
+func (c *collector) takeWarmup(t *target, now time.Time) *warmResult {
+	w := t.warm
+	t.warm = nil
+	if w == nil || !w.expires.IsZero() && now.After(w.expires) {
+		return nil
+	}
+	return w
+}
+
+// warmUp scrapes all targets concurrently, each until it succeeds or the
+// warm-up timeout passed, then closes warmedUp. The scrapes share the bound
+// on concurrent scrapes, but not while waiting to retry.
+func (e *Exporter) warmUp(warmedUp chan<- struct{}) {
+	defer close(warmedUp)
+
+	c := e.currentCollector()
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		up  int
+		sem = make(chan struct{}, e.maxConcurrent)
+	)
+	for _, t := range c.targets {
+		wg.Add(1)
+		go func(t *target) {
+			defer wg.Done()
+			if c.warmUpTarget(t, sem) {
+				mu.Lock()
+				up++
+				mu.Unlock()
+			}
+		}(t)
+	}
+	wg.Wait()
+	e.logger.Info("warm-up complete", zap.Int("targets", len(c.targets)), zap.Int("up", up))
+}
+
+// warmUpTarget scrapes t until it succeeds or the warm-up timeout passed,
+// keeping the last result for the first collection. It reports whether t
+// could be scraped.
+func (c *collector) warmUpTarget(t *target, sem chan struct{}) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), c.exporter.warmupTimeout)
+	defer cancel()
+	defer func() {
+		t.mu.Lock()
+		if t.warm != nil {
+			t.warm.expires = time.Now().Add(c.exporter.warmupTimeout)
+		}
+		t.mu.Unlock()
+	}()
+
+	var err error
+	for {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			c.exporter.logger.Warn("warm-up did not complete before the timeout", zap.String("target", t.url.String()), zap.Error(err))
+			return false
+		}
+		t.mu.Lock()
+		start := time.Now()
+		var body []byte
+		var attempts int
+		body, attempts, err = c.scrapeWithRetry(ctx, t)
+		t.warm = &warmResult{body: body, attempts: attempts, err: err, duration: time.Since(start)}
+		t.mu.Unlock()
+		<-sem
+		if err == nil {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			c.exporter.logger.Warn("warm-up did not complete before the timeout", zap.String("target", t.url.String()), zap.Error(err))
+			return false
+		case <-time.After(warmupInterval):
+		}
+	}
+}
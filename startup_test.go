@@ -0,0 +1,83 @@
+package exporter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingServer serves the status with code and counts the requests.
+func countingServer(code int, hits *int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(hits, 1)
+		w.WriteHeader(code)
+		w.Write([]byte(testStatus))
+	}))
+}
+
+func TestWarmupServesFirstScrape(t *testing.T) {
+	tests := []struct {
+		name string
+		code int
+		want string
+	}{
+		{"up", http.StatusOK, "phpfpm_up 1"},
+		{"down", http.StatusInternalServerError, "phpfpm_up 0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits int64
+			srv := countingServer(tt.code, &hits)
+			defer srv.Close()
+
+			e := newTestExporter(t, SetEndpoint(srv.URL+"/status"), SetWarmup(200*time.Millisecond))
+			e.current = e.newCollector(e.defaultTargets())
+			e.warmedUp = make(chan struct{})
+			e.warmUp(e.warmedUp)
+			warmed := atomic.LoadInt64(&hits)
+
+			w := httptest.NewRecorder()
+			e.metricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+			if !strings.Contains(w.Body.String(), tt.want) {
+				t.Fatalf("first scrape does not contain %q:\n%s", tt.want, w.Body)
+			}
+			if n := atomic.LoadInt64(&hits); n != warmed {
+				t.Errorf("first scrape requested php-fpm %d times after the warm-up", n-warmed)
+			}
+
+			w = httptest.NewRecorder()
+			e.metricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+			if n := atomic.LoadInt64(&hits); n == warmed {
+				t.Error("second scrape did not request php-fpm")
+			}
+		})
+	}
+}
+
+func TestWarmupConcurrentTargets(t *testing.T) {
+	var hits int64
+	var endpoints []string
+	for i := 0; i < 3; i++ {
+		srv := countingServer(http.StatusInternalServerError, &hits)
+		defer srv.Close()
+		endpoints = append(endpoints, srv.URL+"/status")
+	}
+
+	timeout := 300 * time.Millisecond
+	e := newTestExporter(t, SetEndpoints(endpoints), SetWarmup(timeout), SetMaxConcurrentScrapes(1))
+	e.current = e.newCollector(e.defaultTargets())
+	e.warmedUp = make(chan struct{})
+	start := time.Now()
+	e.warmUp(e.warmedUp)
+	if d := time.Since(start); d > 2*timeout {
+		t.Errorf("warm-up of %d targets took %v, want about %v", len(endpoints), d, timeout)
+	}
+	for _, c := range e.current.targets {
+		if c.warm == nil {
+			t.Errorf("target %s has no warm-up result", c.url)
+		}
+	}
+}
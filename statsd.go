@@ -0,0 +1,168 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+)
+
+// maxStatsDPacket keeps StatsD datagrams below the common MTU.
+const maxStatsDPacket = 1432
+
+// SetStatsD creates a function that will enable sending the php-fpm metrics
+// to the StatsD server at address over UDP every interval. Labels are sent as
+// DogStatsD tags.
+// Generally only used when create a new Exporter.
+func SetStatsD(address string, interval time.Duration) func(*Exporter) error {
+	return func(e *Exporter) error {
+		if address == "" {
+			return nil
+		}
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return errors.Wrapf(err, "invalid statsd address %q", address)
+		}
+		if interval <= 0 {
+			return errors.New("statsd interval must be positive")
+		}
+		e.statsdAddress = address
+		e.statsdInterval = interval
+		return nil
+	}
+}
+
+// statsDSender sends metric families to StatsD. Counters are sent as the
+// increase since the previous send, so it keeps the last value of each.
+type statsDSender struct {
+	conn net.Conn
+	last map[string]float64
+}
+
+// statsDLines formats the samples of mfs as StatsD lines: gauges and untyped
+// metrics as gauges and counters as counts. Histograms and summaries are left
+// out. The first value of a counter is only recorded.
+func (s *statsDSender) statsDLines(mfs []*dto.MetricFamily) []string {
+	var lines []string
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			var value float64
+			kind := "g"
+			switch mf.GetType() {
+			case dto.MetricType_GAUGE:
+				value = m.GetGauge().GetValue()
+			case dto.MetricType_UNTYPED:
+				value = m.GetUntyped().GetValue()
+			case dto.MetricType_COUNTER:
+				value = m.GetCounter().GetValue()
+				kind = "c"
+			default:
+				continue
+			}
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				continue
+			}
+
+			tags := make([]string, 0, len(m.GetLabel()))
+			for _, l := range m.GetLabel() {
+				tags = append(tags, l.GetName()+":"+l.GetValue())
+			}
+			sort.Strings(tags)
+			suffix := ""
+			if len(tags) > 0 {
+				suffix = "|#" + strings.Join(tags, ",")
+			}
+
+			if kind == "c" {
+				key := mf.GetName() + suffix
+				last, ok := s.last[key]
+				s.last[key] = value
+				if !ok {
+					continue
+				}
+				if value < last {
+					// the counter was reset, e.g. by a restart of php-fpm
+					last = 0
+				}
+				value -= last
+			}
+			lines = append(lines, mf.GetName()+":"+strconv.FormatFloat(value, 'f', -1, 64)+"|"+kind+suffix)
+		}
+	}
+	return lines
+}
+
+// send gathers the metrics of g and writes them in as few datagrams as
+// possible.
+func (s *statsDSender) send(g prometheus.Gatherer) error {
+	mfs, err := g.Gather()
+	if err != nil {
+		return errors.Wrap(err, "failed to gather metrics")
+	}
+
+	var buf bytes.Buffer
+	flush := func() error {
+		if buf.Len() == 0 {
+			return nil
+		}
+		_, err := s.conn.Write(buf.Bytes())
+		buf.Reset()
+		return err
+	}
+	for _, line := range s.statsDLines(mfs) {
+		if buf.Len() > 0 && buf.Len()+1+len(line) > maxStatsDPacket {
+			if err := flush(); err != nil {
+				return errors.Wrap(err, "failed to send statsd metrics")
+			}
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+	if err := flush(); err != nil {
+		return errors.Wrap(err, "failed to send statsd metrics")
+	}
+	return nil
+}
+
+// runStatsD sends the php-fpm metrics to StatsD every statsdInterval until ctx
+// is done.
+func (e *Exporter) runStatsD(ctx context.Context) error {
+	conn, err := net.Dial("udp", e.statsdAddress)
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to statsd")
+	}
+	defer conn.Close()
+
+	s := &statsDSender{conn: conn, last: make(map[string]float64)}
+	g := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		reg := prometheus.NewRegistry()
+		if err := reg.Register(e.currentCollector()); err != nil {
+			return nil, errors.Wrap(err, "failed to register metrics")
+		}
+		return reg.Gather()
+	})
+
+	ticker := time.NewTicker(e.statsdInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := s.send(g); err != nil {
+				e.logger.Error("failed to send metrics to statsd", zap.Error(err))
+			}
+		}
+	}
+}
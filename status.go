@@ -0,0 +1,375 @@
+package exporter
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// startTimeLayout is the layout of the start time in the text status output.
+const startTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+// Status output formats supported by php-fpm.
+const (
+	formatText = "text"
+	formatJSON = "json"
+	formatXML  = "xml"
+)
+
+// processSeparatorRegexp matches the line separating per-process blocks in
+// the full text status output.
+var processSeparatorRegexp = regexp.MustCompile(`(?m)^\*+\s*$`)
+
+// status is the parsed php-fpm status output.
+type status struct {
+	fields []statusField
+	// processes is only populated when the full status was requested.
+	processes []processStatus
+	// sections holds the status of each pool if the text status repeats the
+	// pool field, e.g. the status of several pools concatenated by a proxy.
+	sections []*status
+}
+
+// pool returns the pool name from the status output, if present.
+func (s *status) pool() string {
+	for _, f := range s.fields {
+		if f.key == "pool" {
+			return f.value
+		}
+	}
+	return ""
+}
+
+// processStatus is the status of a single worker process from the full
+// status output.
+type processStatus struct {
+	PID               int64   `json:"pid"`
+	State             string  `json:"state"`
+	Requests          float64 `json:"requests"`
+	RequestDuration   float64 `json:"request duration"`
+	RequestMethod     string  `json:"request method"`
+	RequestURI        string  `json:"request uri"`
+	ContentLength     float64 `json:"content length"`
+	User              string  `json:"user"`
+	Script            string  `json:"script"`
+	LastRequestCPU    float64 `json:"last request cpu"`
+	LastRequestMemory float64 `json:"last request memory"`
+}
+
+// knownProcessStates are the states a php-fpm worker process can be in.
+var knownProcessStates = []string{"Idle", "Running", "Reading headers", "Info", "Finishing", "Ending"}
+
+// processStateCounts returns the number of processes in each state.
+func (s *status) processStateCounts() map[string]int {
+	counts := make(map[string]int)
+	for _, p := range s.processes {
+		counts[p.State]++
+	}
+	return counts
+}
+
+// statusField is a single key/value pair of php-fpm status output, keyed the
+// same way as the text format, e.g. "accepted conn".
+type statusField struct {
+	key   string
+	value string
+}
+
+// jsonFieldKeys are the pool fields of the json status in the order of the
+// text format. Fields absent from a status are not emitted.
+var jsonFieldKeys = []string{
+	"pool",
+	"process manager",
+	"start time",
+	"start since",
+	"accepted conn",
+	"listen queue",
+	"max listen queue",
+	"listen queue len",
+	"idle processes",
+	"active processes",
+	"total processes",
+	"max active processes",
+	"max children reached",
+	"slow requests",
+	"memory peak",
+}
+
+// jsonFields converts the pool fields of the json status to fields keyed as
+// in the text format. Only the keys present in raw are emitted, so a missing
+// field is told apart from a zero one.
+func jsonFields(raw map[string]json.RawMessage) []statusField {
+	var fields []statusField
+	for _, key := range jsonFieldKeys {
+		value, ok := raw[key]
+		if !ok || string(value) == "null" {
+			continue
+		}
+		var s string
+		if err := json.Unmarshal(value, &s); err == nil {
+			fields = append(fields, statusField{key: key, value: s})
+			continue
+		}
+		var n json.Number
+		if err := json.Unmarshal(value, &n); err == nil {
+			fields = append(fields, statusField{key: key, value: n.String()})
+		}
+	}
+	return fields
+}
+
+// parseTextFieldsStrict splits each line of block into key and value at the
+// first colon, so that values containing colons followed by whitespace are
+// kept whole. Lines without a colon or key are skipped.
+func parseTextFieldsStrict(block string) []statusField {
+	var fields []statusField
+	for _, line := range strings.Split(block, "\n") {
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		key := strings.TrimSpace(line[:i])
+		if key == "" {
+			continue
+		}
+		fields = append(fields, statusField{key: key, value: strings.TrimSpace(line[i+1:])})
+	}
+	return fields
+}
+
+func parseTextFields(block string) []statusField {
+	matches := statusLineRegexp.FindAllStringSubmatch(block, -1)
+	fields := make([]statusField, 0, len(matches))
+	for _, match := range matches {
+		fields = append(fields, statusField{key: match[1], value: match[2]})
+	}
+	return fields
+}
+
+// parseTextProcess builds a process from the fields of a single per-process
+// block. Fields that fail to parse are left at their zero value.
+func parseTextProcess(fields []statusField) processStatus {
+	var p processStatus
+	for _, f := range fields {
+		switch f.key {
+		case "pid":
+			p.PID, _ = strconv.ParseInt(f.value, 10, 64)
+		case "state":
+			p.State = f.value
+		case "requests":
+			p.Requests, _ = strconv.ParseFloat(f.value, 64)
+		case "request duration":
+			p.RequestDuration, _ = strconv.ParseFloat(f.value, 64)
+		case "request method":
+			p.RequestMethod = f.value
+		case "request URI":
+			p.RequestURI = f.value
+		case "content length":
+			p.ContentLength, _ = strconv.ParseFloat(f.value, 64)
+		case "user":
+			p.User = f.value
+		case "script":
+			p.Script = f.value
+		case "last request cpu":
+			p.LastRequestCPU, _ = strconv.ParseFloat(f.value, 64)
+		case "last request memory":
+			p.LastRequestMemory, _ = parseBytes(f.value)
+		}
+	}
+	return p
+}
+
+// byteSuffixes are the multipliers of the suffixes of memory values.
+var byteSuffixes = map[string]float64{
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+}
+
+// parseBytes parses a memory value such as 2097152, "2048 bytes" or 2M into
+// bytes. It is only meant for memory fields, counters must be plain numbers.
+// The bytes unit only follows a plain number, so "2Kbytes" is invalid.
+func parseBytes(value string) (float64, error) {
+	value = strings.TrimSpace(value)
+
+	multiplier := 1.0
+	if v := strings.TrimSuffix(value, "bytes"); v != value {
+		value = strings.TrimSpace(v)
+	} else if n := len(value); n > 0 {
+		if m, ok := byteSuffixes[strings.ToUpper(value[n-1:])]; ok {
+			multiplier = m
+			value = strings.TrimSpace(value[:n-1])
+		}
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "invalid memory value")
+	}
+	return f * multiplier, nil
+}
+
+// splitPools splits fields into one status per pool field, if there is more
+// than one. Fields before the first pool field go to the first section.
+func splitPools(fields []statusField) []*status {
+	var sections []*status
+	for _, f := range fields {
+		if len(sections) == 0 || f.key == "pool" && sections[len(sections)-1].pool() != "" {
+			sections = append(sections, &status{})
+		}
+		last := sections[len(sections)-1]
+		last.fields = append(last.fields, f)
+	}
+	if len(sections) < 2 {
+		return nil
+	}
+	return sections
+}
+
+// parseText parses the plain text status, splitting lines with the strict
+// parser if strict is set and the regular expression otherwise.
+func parseText(body []byte, strict bool) *status {
+	parseFields := parseTextFields
+	if strict {
+		parseFields = parseTextFieldsStrict
+	}
+
+	blocks := processSeparatorRegexp.Split(string(body), -1)
+	s := &status{
+		fields: parseFields(blocks[0]),
+	}
+	s.sections = splitPools(s.fields)
+	for _, block := range blocks[1:] {
+		fields := parseFields(block)
+		if len(fields) == 0 {
+			continue
+		}
+		s.processes = append(s.processes, parseTextProcess(fields))
+	}
+	return s
+}
+
+func parseJSON(body []byte) (*status, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, errors.Wrap(err, "failed to parse json status")
+	}
+	st := &status{
+		fields: jsonFields(raw),
+	}
+	if processes, ok := raw["processes"]; ok {
+		if err := json.Unmarshal(processes, &st.processes); err != nil {
+			return nil, errors.Wrap(err, "failed to parse json status")
+		}
+	}
+	return st, nil
+}
+
+// xmlElement is an element of the php-fpm status as returned with ?xml.
+type xmlElement struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
+
+// xmlStatus is the php-fpm status as returned with ?xml.
+type xmlStatus struct {
+	Elements  []xmlElement `xml:",any"`
+	Processes []struct {
+		Elements []xmlElement `xml:",any"`
+	} `xml:"processes>process"`
+}
+
+// xmlFields converts elements to fields keyed as in the text format, e.g.
+// <accepted-conn> to "accepted conn".
+func xmlFields(elements []xmlElement) []statusField {
+	fields := make([]statusField, 0, len(elements))
+	for _, el := range elements {
+		key := strings.Replace(el.XMLName.Local, "-", " ", -1)
+		if key == "request uri" {
+			key = "request URI"
+		}
+		fields = append(fields, statusField{key: key, value: strings.TrimSpace(el.Value)})
+	}
+	return fields
+}
+
+func parseXML(body []byte) (*status, error) {
+	var s xmlStatus
+	if err := xml.Unmarshal(body, &s); err != nil {
+		return nil, errors.Wrap(err, "failed to parse xml status")
+	}
+	st := &status{
+		fields: xmlFields(s.Elements),
+	}
+	for _, p := range s.Processes {
+		st.processes = append(st.processes, parseTextProcess(xmlFields(p.Elements)))
+	}
+	return st, nil
+}
+
+// parseStartTime parses a start time given either as a unix timestamp, as in
+// the json and xml output, or formatted as in the text output.
+func parseStartTime(value string) (time.Time, error) {
+	if sec, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Unix(int64(sec), 0), nil
+	}
+	ts, err := time.Parse(startTimeLayout, value)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "invalid start time")
+	}
+	return ts, nil
+}
+
+// parseStatus parses body according to format. strict selects the strict line
+// parser for the text format.
+func parseStatus(format string, body []byte, strict bool) (*status, error) {
+	switch format {
+	case formatJSON:
+		return parseJSON(body)
+	case formatXML:
+		return parseXML(body)
+	default:
+		return parseText(body, strict), nil
+	}
+}
+
+// statusQuery returns the raw query of u with extra and the flag selecting
+// format appended, so that php-fpm returns the status in that format.
+func statusQuery(u *url.URL, format string, extra ...string) string {
+	parts := append([]string{u.RawQuery}, extra...)
+	if format != formatText && format != "" {
+		parts = append(parts, format)
+	}
+
+	var query []string
+	for _, part := range parts {
+		if part != "" {
+			query = append(query, part)
+		}
+	}
+	return strings.Join(query, "&")
+}
+
+// withStatusQuery returns a copy of u requesting format.
+func withStatusQuery(u *url.URL, format string) *url.URL {
+	c := *u
+	c.RawQuery = statusQuery(u, format)
+	return &c
+}
+
+// withStatusPath returns u with its path set to path if it has none. The path
+// of unix urls is the socket, so they are returned unchanged.
+func withStatusPath(u *url.URL, path string) *url.URL {
+	if path == "" || u.Path != "" || u.Scheme == "unix" {
+		return u
+	}
+	c := *u
+	c.Path = path
+	return &c
+}
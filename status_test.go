@@ -0,0 +1,187 @@
+package exporter
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseJSONFields(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []statusField
+	}{
+		{
+			"with memory peak",
+			`{"pool":"www","accepted conn":42,"listen queue len":128,"memory peak":2097152}`,
+			[]statusField{{"pool", "www"}, {"accepted conn", "42"}, {"listen queue len", "128"}, {"memory peak", "2097152"}},
+		},
+		{
+			"without memory peak",
+			`{"pool":"www","accepted conn":42,"listen queue len":128}`,
+			[]statusField{{"pool", "www"}, {"accepted conn", "42"}, {"listen queue len", "128"}},
+		},
+		{
+			"without listen queue len",
+			`{"pool":"www","accepted conn":0}`,
+			[]statusField{{"pool", "www"}, {"accepted conn", "0"}},
+		},
+		{
+			"null field",
+			`{"pool":"www","slow requests":null}`,
+			[]statusField{{"pool", "www"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, err := parseJSON([]byte(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(st.fields, tt.want) {
+				t.Errorf("fields %v, want %v", st.fields, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseJSONProcesses(t *testing.T) {
+	st, err := parseJSON([]byte(`{"pool":"www","processes":[{"pid":7,"state":"Idle","request uri":"/a"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []processStatus{{PID: 7, State: "Idle", RequestURI: "/a"}}
+	if !reflect.DeepEqual(st.processes, want) {
+		t.Errorf("processes %+v, want %+v", st.processes, want)
+	}
+}
+
+func TestParseTextCRLF(t *testing.T) {
+	crlf := strings.Replace(fullStatus, "\n", "\r\n", -1)
+	for _, strict := range []bool{false, true} {
+		want := parseText([]byte(fullStatus), strict)
+		got := parseText([]byte(crlf), strict)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("strict %v: CRLF status parsed as %+v, want %+v", strict, got, want)
+		}
+		if len(got.processes) != 3 {
+			t.Errorf("strict %v: %d processes parsed from CRLF status, want 3", strict, len(got.processes))
+		}
+	}
+}
+
+func TestParseTextFieldsWhitespace(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want []statusField
+	}{
+		{"LF", "accepted conn:        42\n", []statusField{{"accepted conn", "42"}}},
+		{"CRLF", "accepted conn:        42\r\n", []statusField{{"accepted conn", "42"}}},
+		{"trailing spaces", "accepted conn:        42  \t\r\n", []statusField{{"accepted conn", "42"}}},
+		{"tab separator", "accepted conn:\t42\r\n", []statusField{{"accepted conn", "42"}}},
+		{"empty value", "user:                 \r\nscript:               -\r\n", []statusField{{"user", ""}, {"script", "-"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseTextFields(tt.line); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTextFields(%q) = %v, want %v", tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTextStrict(t *testing.T) {
+	// on real status bodies both parsers agree
+	for _, body := range []string{testStatus, fullStatus} {
+		for _, block := range processSeparatorRegexp.Split(body, -1) {
+			regex, strict := parseTextFields(block), parseTextFieldsStrict(block)
+			if !reflect.DeepEqual(strict, regex) {
+				t.Errorf("strict parser returned %v, regular expression %v", strict, regex)
+			}
+		}
+	}
+
+	tests := []struct {
+		name   string
+		line   string
+		regex  []statusField
+		strict []statusField
+	}{
+		{
+			"start time",
+			"start time:           01/Jan/2024:12:00:00 +0000",
+			[]statusField{{"start time", "01/Jan/2024:12:00:00 +0000"}},
+			[]statusField{{"start time", "01/Jan/2024:12:00:00 +0000"}},
+		},
+		{
+			"colon and space in value",
+			"request URI:          /index.php?q=a: b",
+			[]statusField{{"request URI:          /index.php?q=a", "b"}},
+			[]statusField{{"request URI", "/index.php?q=a: b"}},
+		},
+		{
+			"no space after colon",
+			"accepted conn:42",
+			[]statusField{},
+			[]statusField{{"accepted conn", "42"}},
+		},
+		{
+			"no key",
+			": 42",
+			[]statusField{{"", "42"}},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseTextFields(tt.line); !reflect.DeepEqual(got, tt.regex) {
+				t.Errorf("regular expression parsed %q as %v, want %v", tt.line, got, tt.regex)
+			}
+			if got := parseTextFieldsStrict(tt.line); !reflect.DeepEqual(got, tt.strict) {
+				t.Errorf("strict parser parsed %q as %v, want %v", tt.line, got, tt.strict)
+			}
+		})
+	}
+}
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		value string
+		want  float64
+		ok    bool
+	}{
+		{"2097152", 2097152, true},
+		{" 2097152 ", 2097152, true},
+		{"0", 0, true},
+		{"1.5", 1.5, true},
+		{"2048 bytes", 2048, true},
+		{"2048bytes", 2048, true},
+		{"2K", 2048, true},
+		{"2k", 2048, true},
+		{"2 K", 2048, true},
+		{"2M", 2 << 20, true},
+		{"2m", 2 << 20, true},
+		{"1.5M", 1.5 * (1 << 20), true},
+		{"2G", 2 << 30, true},
+		{"2g", 2 << 30, true},
+		{"2Kbytes", 0, false},
+		{"2K bytes", 0, false},
+		{"bytes", 0, false},
+		{"", 0, false},
+		{"K", 0, false},
+		{"2T", 0, false},
+		{"two", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseBytes(tt.value)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseBytes(%q) returned error %v, want success %v", tt.value, err, tt.ok)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseBytes(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
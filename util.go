@@ -1,20 +1,40 @@
 package exporter
 
 import (
+	"bytes"
+	"mime"
+	"unicode/utf8"
+
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
 )
 
 // NewLogger creates a new logger with our prefered options
 func NewLogger() (*zap.Logger, error) {
+	return NewLoggerWithConfig("json", "info")
+}
+
+// NewLoggerWithConfig creates a new logger with our prefered options, encoding
+// as json or console and logging at level and above.
+func NewLoggerWithConfig(format string, level string) (*zap.Logger, error) {
+	if format != "json" && format != "console" {
+		return nil, errors.Errorf("unsupported log format %q", format)
+	}
+	lvl := zap.NewAtomicLevel()
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, errors.Wrapf(err, "invalid log level %q", level)
+	}
+
 	config := zap.Config{
 		Development:       false,
 		DisableCaller:     true,
 		DisableStacktrace: true,
 		EncoderConfig:     zap.NewProductionEncoderConfig(),
-		Encoding:          "json",
+		Encoding:          format,
 		ErrorOutputPaths:  []string{"stdout"},
-		Level:             zap.NewAtomicLevel(),
+		Level:             lvl,
 		OutputPaths:       []string{"stdout"},
 	}
 	l, err := config.Build()
@@ -23,3 +43,67 @@ func NewLogger() (*zap.Logger, error) {
 	}
 	return l, nil
 }
+
+// maxLoggedBody is the number of bytes of a status body included in logs.
+const maxLoggedBody = 4096
+
+// truncateBody shortens body to at most maxLoggedBody bytes for logging.
+func truncateBody(body []byte) []byte {
+	if len(body) > maxLoggedBody {
+		return body[:maxLoggedBody]
+	}
+	return body
+}
+
+// toUTF8 transcodes body to UTF-8 based on the charset declared in
+// contentType, using the labels of the WHATWG encoding standard. A missing
+// charset is assumed to be UTF-8 already. A charset that cannot be resolved
+// or decoded is returned as an error along with body unchanged.
+func toUTF8(body []byte, contentType string) ([]byte, error) {
+	if contentType == "" {
+		return body, nil
+	}
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return body, nil
+	}
+	name := params["charset"]
+	if name == "" {
+		return body, nil
+	}
+
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return body, errors.Errorf("unsupported charset %q", name)
+	}
+	if enc == unicode.UTF8 {
+		return body, nil
+	}
+	decoded, err := enc.NewDecoder().Bytes(body)
+	if err != nil {
+		return body, errors.Wrapf(err, "failed to decode charset %q", name)
+	}
+	return decoded, nil
+}
+
+// isText reports whether body looks like text rather than binary data, e.g.
+// a compressed body that was not decoded.
+func isText(body []byte) bool {
+	return utf8.Valid(body) && !bytes.ContainsRune(body, 0)
+}
+
+// isUnexpectedContent reports whether body looks like markup, e.g. an HTML
+// error page returned with a 200, rather than status output in format.
+func isUnexpectedContent(format string, body []byte) bool {
+	body = bytes.TrimSpace(bytes.TrimPrefix(body, []byte("\xef\xbb\xbf")))
+	if format == formatXML {
+		// the xml status is markup too, so only look for html
+		head := body
+		if len(head) > 16 {
+			head = head[:16]
+		}
+		lower := bytes.ToLower(head)
+		return bytes.HasPrefix(lower, []byte("<!doctype html")) || bytes.HasPrefix(lower, []byte("<html"))
+	}
+	return bytes.HasPrefix(body, []byte("<"))
+}
@@ -0,0 +1,100 @@
+package exporter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsUnexpectedContent(t *testing.T) {
+	tests := []struct {
+		format string
+		body   string
+		want   bool
+	}{
+		{formatText, testStatus, false},
+		{formatText, "<html><body>404</body></html>", true},
+		{formatText, "\xef\xbb\xbf\n  <!DOCTYPE html>", true},
+		{formatJSON, `{"pool":"www"}`, false},
+		{formatXML, `<?xml version="1.0" ?><status></status>`, false},
+		{formatXML, "<!DOCTYPE html><html>", true},
+		{formatXML, "<HTML>", true},
+		{formatXML, "<h", false},
+		{formatXML, "", false},
+	}
+	for _, tt := range tests {
+		if got := isUnexpectedContent(tt.format, []byte(tt.body)); got != tt.want {
+			t.Errorf("isUnexpectedContent(%s, %q) = %v, want %v", tt.format, tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestIsText(t *testing.T) {
+	tests := []struct {
+		body string
+		want bool
+	}{
+		{testStatus, true},
+		{"pool: café", true},
+		{"\x1f\x8b\x08\x00\x00\x00\x00\x00", false},
+		{"pool: www\x00", false},
+		{"", true},
+	}
+	for _, tt := range tests {
+		if got := isText([]byte(tt.body)); got != tt.want {
+			t.Errorf("isText(%q) = %v, want %v", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestToUTF8(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		want        string
+		ok          bool
+	}{
+		{"", "pool: caf\xe9", "pool: caf\xe9", true},
+		{"text/plain", "pool: café", "pool: café", true},
+		{"text/plain; charset=utf-8", "pool: café", "pool: café", true},
+		{"text/plain; charset=UTF8", "pool: café", "pool: café", true},
+		{"text/plain; charset=ISO-8859-1", "pool: caf\xe9", "pool: café", true},
+		{"text/plain; charset=latin1", "pool: \xfc\xdf", "pool: üß", true},
+		{"text/plain; charset=windows-1252", "pool: caf\xe9 \x80", "pool: café €", true},
+		{"text/plain; charset=ISO-8859-15", "pool: caf\xe9 \xa4", "pool: café €", true},
+		{"text/plain; charset=x-unknown", "pool: caf\xe9", "pool: caf\xe9", false},
+		{"text/plain; charset", "pool: caf\xe9", "pool: caf\xe9", true},
+	}
+	for _, tt := range tests {
+		got, err := toUTF8([]byte(tt.body), tt.contentType)
+		if (err == nil) != tt.ok {
+			t.Errorf("toUTF8(%q, %q) returned error %v, want success %v", tt.body, tt.contentType, err, tt.ok)
+		}
+		if string(got) != tt.want {
+			t.Errorf("toUTF8(%q, %q) = %q, want %q", tt.body, tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestLatin1Status(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=iso-8859-1")
+		w.Write([]byte("pool: caf\xe9\naccepted conn: 42\n"))
+	}))
+	defer srv.Close()
+
+	e := newTestExporter(t, SetEndpoint(srv.URL+"/status"), SetPoolLabel(true))
+	c := e.newCollector(e.defaultTargets())
+	body, err := c.scrape(context.Background(), c.targets[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := parseStatus(formatText, body, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pool := st.pool(); pool != "café" {
+		t.Errorf("pool %q, want café", pool)
+	}
+}
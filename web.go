@@ -0,0 +1,160 @@
+package exporter
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// webConfig is the subset of the exporter-toolkit web configuration file
+// that is supported.
+type webConfig struct {
+	TLSServerConfig *struct {
+		CertFile       string `yaml:"cert_file"`
+		KeyFile        string `yaml:"key_file"`
+		ClientAuthType string `yaml:"client_auth_type"`
+		ClientCAFile   string `yaml:"client_ca_file"`
+		MinVersion     string `yaml:"min_version"`
+	} `yaml:"tls_server_config"`
+	BasicAuthUsers map[string]string `yaml:"basic_auth_users"`
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":                           tls.NoClientCert,
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+var tlsVersions = map[string]uint16{
+	"":      tls.VersionTLS12,
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	// tls.VersionTLS13 needs Go 1.12, older releases cannot negotiate it
+	"TLS13": 0x0304,
+}
+
+// unknownUserHash is compared with the password given for an unknown user, so
+// that the time taken does not tell which users exist.
+var unknownUserHash = []byte("$2a$10$iy9AgV9m5hIwXUzr2qlISuiRlfk5FNomOsh4M5MMmwJjUuoA1.3Bu")
+
+// SetWebConfigFile creates a function that will enable TLS and basic auth on
+// the listener as configured in the file at path. An empty path keeps plain
+// HTTP without authentication.
+// Generally only used when create a new Exporter.
+func SetWebConfigFile(path string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		if path == "" {
+			return nil
+		}
+		c, users, err := loadWebConfig(path)
+		if err != nil {
+			return errors.Wrapf(err, "failed to load web config %s", path)
+		}
+		e.tlsConfig = c
+		e.authUsers = users
+		return nil
+	}
+}
+
+// loadWebConfig reads the web configuration file and returns the TLS config
+// of the listener, or nil if TLS is not configured, and the bcrypt password
+// hashes of the basic auth users.
+func loadWebConfig(path string) (*tls.Config, map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to read file")
+	}
+
+	var c webConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&c); err != nil && err != io.EOF {
+		return nil, nil, errors.Wrap(err, "failed to parse file")
+	}
+	for user, hash := range c.BasicAuthUsers {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, nil, errors.Wrapf(err, "invalid bcrypt hash of user %q", user)
+		}
+	}
+
+	config, err := c.serverTLSConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	return config, c.BasicAuthUsers, nil
+}
+
+// serverTLSConfig returns the TLS config of the listener, or nil if TLS is not
+// configured.
+func (c *webConfig) serverTLSConfig() (*tls.Config, error) {
+	s := c.TLSServerConfig
+	if s == nil {
+		return nil, nil
+	}
+	if s.CertFile == "" || s.KeyFile == "" {
+		return nil, errors.New("cert_file and key_file are required")
+	}
+	cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load certificate")
+	}
+
+	clientAuth, ok := clientAuthTypes[s.ClientAuthType]
+	if !ok {
+		return nil, errors.Errorf("invalid client_auth_type %q", s.ClientAuthType)
+	}
+	minVersion, ok := tlsVersions[s.MinVersion]
+	if !ok {
+		return nil, errors.Errorf("invalid min_version %q", s.MinVersion)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   clientAuth,
+		MinVersion:   minVersion,
+	}
+	if s.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(s.ClientCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read client_ca_file")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in client_ca_file")
+		}
+		config.ClientCAs = pool
+	}
+	return config, nil
+}
+
+// authenticate wraps h to require one of the basic auth users of the web
+// config, if there are any.
+func (e *Exporter) authenticate(h http.Handler) http.Handler {
+	if len(e.authUsers) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		hash, known := e.authUsers[user]
+		if !known {
+			hash = string(unknownUserHash)
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil || !ok || !known {
+			w.Header().Set("WWW-Authenticate", `Basic realm="php-fpm-exporter"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,127 @@
+package exporter
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// secretHash is a bcrypt hash of the password secret.
+const secretHash = "$2a$10$85El1NxZfTzW2.7JCl/UguxS3liz8AXL9NlR/4HL08OgGXaigkicu"
+
+func TestLoadWebConfig(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	certFile, keyFile := writeKeyPair(t, dir)
+
+	tests := []struct {
+		name       string
+		content    string
+		tls        bool
+		minVersion uint16
+		users      int
+		wantErr    bool
+	}{
+		{name: "empty", content: ""},
+		{
+			name:       "yaml tls",
+			content:    "tls_server_config:\n  cert_file: " + certFile + "\n  key_file: " + keyFile + "\n",
+			tls:        true,
+			minVersion: tls.VersionTLS12,
+		},
+		{
+			name:       "json tls",
+			content:    `{"tls_server_config": {"cert_file": "` + certFile + `", "key_file": "` + keyFile + `", "min_version": "TLS13"}}`,
+			tls:        true,
+			minVersion: 0x0304,
+		},
+		{
+			name:    "basic auth users",
+			content: "basic_auth_users:\n  prometheus: " + secretHash + "\n  htpasswd: " + strings.Replace(secretHash, "$2a$", "$2y$", 1) + "\n",
+			users:   2,
+		},
+		{name: "unknown key", content: "http_server_config:\n  http2: true\n", wantErr: true},
+		{name: "plain password", content: "basic_auth_users:\n  prometheus: secret\n", wantErr: true},
+		{name: "missing key file", content: "tls_server_config:\n  cert_file: " + certFile + "\n", wantErr: true},
+		{name: "invalid min version", content: "tls_server_config:\n  cert_file: " + certFile + "\n  key_file: " + keyFile + "\n  min_version: SSL3\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "web.yml")
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			config, users, err := loadWebConfig(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if (config != nil) != tt.tls {
+				t.Fatalf("TLS config %v, want TLS %v", config, tt.tls)
+			}
+			if config != nil && config.MinVersion != tt.minVersion {
+				t.Errorf("min version %#x, want %#x", config.MinVersion, tt.minVersion)
+			}
+			if len(users) != tt.users {
+				t.Errorf("%d users, want %d", len(users), tt.users)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	e := newTestExporter(t)
+	e.authUsers = map[string]string{
+		"prometheus": secretHash,
+		"htpasswd":   strings.Replace(secretHash, "$2a$", "$2y$", 1),
+	}
+	h := e.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		noAuth   bool
+		code     int
+	}{
+		{name: "valid", user: "prometheus", password: "secret", code: http.StatusOK},
+		{name: "htpasswd hash", user: "htpasswd", password: "secret", code: http.StatusOK},
+		{name: "wrong password", user: "prometheus", password: "guess", code: http.StatusUnauthorized},
+		{name: "unknown user", user: "root", password: "secret", code: http.StatusUnauthorized},
+		{name: "no credentials", noAuth: true, code: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/metrics", nil)
+			if !tt.noAuth {
+				r.SetBasicAuth(tt.user, tt.password)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.code {
+				t.Errorf("status %d, want %d", w.Code, tt.code)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("WWW-Authenticate header missing")
+			}
+		})
+	}
+}
+
+func TestAuthenticateWithoutUsers(t *testing.T) {
+	e := newTestExporter(t)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	w := httptest.NewRecorder()
+	e.authenticate(h).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status %d without basic auth users, want 200", w.Code)
+	}
+}